@@ -0,0 +1 @@
+DROP INDEX IF EXISTS microservices.events_aggregate_id_version_uindex;
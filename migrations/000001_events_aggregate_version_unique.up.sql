@@ -0,0 +1,13 @@
+DROP INDEX IF EXISTS microservices.events_aggregate_id_version_uindex;
+
+-- Save used to stamp all events of one save with the final aggregate version, so streams may contain duplicate versions.
+-- Renumber every stream to 1..n keeping stored order, the last event of each save keeps its version,
+-- so snapshot versions stay valid. Events of one save share timestamp, ctid keeps their insert order.
+UPDATE microservices.events e
+SET version = r.row_number
+FROM (SELECT event_id, ROW_NUMBER() OVER (PARTITION BY aggregate_id ORDER BY version, timestamp, ctid) AS row_number
+      FROM microservices.events) r
+WHERE e.event_id = r.event_id
+  AND e.version <> r.row_number;
+
+CREATE UNIQUE INDEX IF NOT EXISTS events_aggregate_id_version_uindex ON microservices.events USING btree (aggregate_id, version);
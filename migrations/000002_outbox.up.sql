@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS microservices.outbox
+(
+    id              BIGSERIAL PRIMARY KEY,
+    event_id        VARCHAR(250)             NOT NULL,
+    aggregate_id    VARCHAR(250)             NOT NULL,
+    aggregate_type  VARCHAR(250)             NOT NULL,
+    event_type      VARCHAR(250)             NOT NULL,
+    data            BYTEA,
+    version         BIGINT                   NOT NULL,
+    metadata        BYTEA,
+    timestamp       TIMESTAMP WITH TIME ZONE NOT NULL,
+    attempts        INTEGER                  NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    last_error      TEXT,
+    sent_at         TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON microservices.outbox USING btree (id) WHERE sent_at IS NULL;
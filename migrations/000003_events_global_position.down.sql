@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS microservices.events_position_uindex;
+ALTER TABLE microservices.events DROP COLUMN IF EXISTS position;
+DROP SEQUENCE IF EXISTS microservices.events_position_seq;
@@ -0,0 +1,17 @@
+CREATE SEQUENCE IF NOT EXISTS microservices.events_position_seq;
+
+ALTER TABLE microservices.events ADD COLUMN IF NOT EXISTS position BIGINT;
+
+UPDATE microservices.events e SET position = o.rn
+FROM (SELECT event_id, row_number() OVER (ORDER BY timestamp, aggregate_id, version) AS rn FROM microservices.events) o
+WHERE e.event_id = o.event_id AND e.position IS NULL;
+
+SELECT setval('microservices.events_position_seq', COALESCE((SELECT MAX(position) FROM microservices.events), 0) + 1, false);
+
+ALTER TABLE microservices.events
+    ALTER COLUMN position SET DEFAULT nextval('microservices.events_position_seq'),
+    ALTER COLUMN position SET NOT NULL;
+
+ALTER SEQUENCE microservices.events_position_seq OWNED BY microservices.events.position;
+
+CREATE UNIQUE INDEX IF NOT EXISTS events_position_uindex ON microservices.events USING btree (position);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS microservices.subscription_checkpoints;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS microservices.subscription_checkpoints
+(
+    subscription_id VARCHAR(250) PRIMARY KEY,
+    position        BIGINT                   NOT NULL,
+    updated_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
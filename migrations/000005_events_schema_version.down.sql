@@ -0,0 +1,3 @@
+ALTER TABLE microservices.outbox DROP COLUMN IF EXISTS schema_version;
+
+ALTER TABLE microservices.events DROP COLUMN IF EXISTS schema_version;
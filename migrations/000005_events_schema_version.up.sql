@@ -0,0 +1,3 @@
+ALTER TABLE microservices.events ADD COLUMN IF NOT EXISTS schema_version INTEGER NOT NULL DEFAULT 1;
+
+ALTER TABLE microservices.outbox ADD COLUMN IF NOT EXISTS schema_version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS microservices.snapshots_aggregate_type_schema_version_idx;
+
+ALTER TABLE microservices.snapshots DROP COLUMN IF EXISTS schema_version;
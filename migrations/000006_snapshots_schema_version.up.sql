@@ -0,0 +1,3 @@
+ALTER TABLE microservices.snapshots ADD COLUMN IF NOT EXISTS schema_version INTEGER NOT NULL DEFAULT 1;
+
+CREATE INDEX IF NOT EXISTS snapshots_aggregate_type_schema_version_idx ON microservices.snapshots (aggregate_type, schema_version);
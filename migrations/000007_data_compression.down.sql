@@ -0,0 +1,3 @@
+ALTER TABLE microservices.snapshots DROP COLUMN IF EXISTS data_compression;
+
+ALTER TABLE microservices.events DROP COLUMN IF EXISTS data_compression;
@@ -0,0 +1,3 @@
+ALTER TABLE microservices.events ADD COLUMN IF NOT EXISTS data_compression TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE microservices.snapshots ADD COLUMN IF NOT EXISTS data_compression TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS microservices.encryption_keys
+(
+    subject_id    VARCHAR(250) PRIMARY KEY,
+    encrypted_key BYTEA,
+    created_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    forgotten_at  TIMESTAMP WITH TIME ZONE
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS microservices.streams
+(
+    aggregate_id   VARCHAR(250) PRIMARY KEY,
+    aggregate_type VARCHAR(250)             NOT NULL,
+    state          VARCHAR(20)              NOT NULL DEFAULT 'active',
+    updated_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS microservices.archives
+(
+    id             BIGSERIAL PRIMARY KEY,
+    aggregate_id   VARCHAR(250)             NOT NULL,
+    aggregate_type VARCHAR(250)             NOT NULL,
+    segment_key    TEXT                     NOT NULL UNIQUE,
+    from_version   BIGINT                   NOT NULL,
+    to_version     BIGINT                   NOT NULL,
+    from_timestamp TIMESTAMP WITH TIME ZONE NOT NULL,
+    to_timestamp   TIMESTAMP WITH TIME ZONE NOT NULL,
+    events_count   INTEGER                  NOT NULL,
+    created_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS archives_aggregate_id_to_version_idx ON microservices.archives USING btree (aggregate_id, to_version);
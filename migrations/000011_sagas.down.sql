@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS microservices.saga_events;
+DROP TABLE IF EXISTS microservices.sagas;
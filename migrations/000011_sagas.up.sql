@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS microservices.sagas
+(
+    saga_id         VARCHAR(250) PRIMARY KEY,
+    saga_type       VARCHAR(250)             NOT NULL,
+    correlation_key VARCHAR(250)             NOT NULL,
+    status          VARCHAR(20)              NOT NULL,
+    state           BYTEA,
+    steps           TEXT[]                   NOT NULL DEFAULT '{}',
+    failure_reason  TEXT,
+    version         BIGINT                   NOT NULL,
+    created_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    updated_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    UNIQUE (saga_type, correlation_key)
+);
+
+CREATE TABLE IF NOT EXISTS microservices.saga_events
+(
+    saga_id      VARCHAR(250)             NOT NULL REFERENCES microservices.sagas (saga_id) ON DELETE CASCADE,
+    event_id     VARCHAR(250)             NOT NULL,
+    processed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    PRIMARY KEY (saga_id, event_id)
+);
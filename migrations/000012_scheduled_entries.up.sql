@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS microservices.scheduled_entries
+(
+    id           BIGSERIAL PRIMARY KEY,
+    key          VARCHAR(250)             NOT NULL UNIQUE,
+    entry_type   VARCHAR(250)             NOT NULL,
+    payload      BYTEA,
+    due_at       TIMESTAMP WITH TIME ZONE NOT NULL,
+    attempts     INTEGER                  NOT NULL DEFAULT 0,
+    lock_token   VARCHAR(250),
+    locked_until TIMESTAMP WITH TIME ZONE,
+    last_error   TEXT,
+    failed_at    TIMESTAMP WITH TIME ZONE,
+    created_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS scheduled_entries_due_idx ON microservices.scheduled_entries USING btree (due_at) WHERE failed_at IS NULL;
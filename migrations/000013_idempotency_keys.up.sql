@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS microservices.idempotency_keys
+(
+    idempotency_key VARCHAR(250)             NOT NULL,
+    aggregate_id    VARCHAR(250)             NOT NULL,
+    aggregate_type  VARCHAR(250)             NOT NULL,
+    version         BIGINT                   NOT NULL,
+    created_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    expires_at      TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (idempotency_key, aggregate_id)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON microservices.idempotency_keys USING btree (expires_at);
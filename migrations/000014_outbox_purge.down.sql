@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS microservices.outbox_sent_at_idx;
+DROP INDEX IF EXISTS microservices.outbox_pending_aggregate_idx;
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS outbox_pending_aggregate_idx ON microservices.outbox USING btree (aggregate_id, id) WHERE sent_at IS NULL;
+CREATE INDEX IF NOT EXISTS outbox_sent_at_idx ON microservices.outbox USING btree (sent_at) WHERE sent_at IS NOT NULL;
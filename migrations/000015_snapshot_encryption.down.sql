@@ -0,0 +1 @@
+ALTER TABLE microservices.snapshots DROP COLUMN IF EXISTS subject_id;
@@ -0,0 +1 @@
+ALTER TABLE microservices.snapshots ADD COLUMN IF NOT EXISTS subject_id TEXT NOT NULL DEFAULT '';
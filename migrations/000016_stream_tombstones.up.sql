@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS microservices.stream_tombstones
+(
+    position       BIGINT PRIMARY KEY       NOT NULL DEFAULT nextval('microservices.events_position_seq'),
+    event_id       VARCHAR(250)             NOT NULL,
+    aggregate_id   VARCHAR(250)             NOT NULL,
+    aggregate_type VARCHAR(250)             NOT NULL,
+    event_type     VARCHAR(250)             NOT NULL,
+    data           BYTEA,
+    metadata       BYTEA,
+    timestamp      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS stream_tombstones_aggregate_id_idx ON microservices.stream_tombstones USING btree (aggregate_id);
@@ -58,6 +58,14 @@ type AggregateBase struct {
 	Changes []any
 	Type    AggregateType
 	when    when
+
+	readOnly bool
+}
+
+// ReadOnly implemented by aggregates which can be loaded as read-only historical state.
+type ReadOnly interface {
+	MarkReadOnly()
+	IsReadOnly() bool
 }
 
 // NewAggregateBase constructor, contains all main fields and methods,
@@ -136,6 +144,10 @@ func (a *AggregateBase) Load(events []any) error {
 
 // Apply push event to aggregate uncommitted events using When method
 func (a *AggregateBase) Apply(event any) error {
+	if a.readOnly {
+		return ErrReadOnlyAggregate
+	}
+
 	if err := a.when(event); err != nil {
 		return err
 	}
@@ -155,6 +167,16 @@ func (a *AggregateBase) RaiseEvent(event any) error {
 	return nil
 }
 
+// MarkReadOnly forbid applying new events and saving the AggregateBase, used for historical state.
+func (a *AggregateBase) MarkReadOnly() {
+	a.readOnly = true
+}
+
+// IsReadOnly true if AggregateBase was loaded as historical state.
+func (a *AggregateBase) IsReadOnly() bool {
+	return a.readOnly
+}
+
 // ToSnapshot prepare AggregateBase for saving Snapshot.
 func (a *AggregateBase) ToSnapshot() {
 	a.ClearChanges()
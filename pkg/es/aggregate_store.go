@@ -2,6 +2,8 @@ package es
 
 import (
 	"context"
+	"math"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
@@ -10,6 +12,7 @@ import (
 	"github.com/jackc/pgx/v4"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
+	uuid "github.com/satori/go.uuid"
 )
 
 // Load es.Aggregate events using snapshots with given frequency
@@ -19,17 +22,29 @@ func (p *pgEventStore) Load(ctx context.Context, aggregate Aggregate) error {
 	span.LogFields(log.String("aggregate", aggregate.String()))
 
 	snapshot, err := p.GetSnapshot(ctx, aggregate.GetID())
-	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+	if err != nil && !isSnapshotMissing(err) {
 		return tracing.TraceWithErr(span, err)
 	}
 
 	if snapshot != nil {
+		snapshot, ok := p.usableSnapshot(aggregate, snapshot)
+		if !ok {
+			// snapshot of another schema version, fallback to the full replay
+			if err := p.loadFullHistory(ctx, aggregate, math.MaxInt64); err != nil {
+				return err
+			}
+
+			p.log.Debugf("(Load Aggregate Without Snapshot) aggregate: %s", aggregate.String())
+			span.LogFields(log.String("aggregate with events", aggregate.String()))
+			return nil
+		}
+
 		if err := serializer.Unmarshal(snapshot.State, aggregate); err != nil {
 			p.log.Errorf("(Load) serializer.Unmarshal err: %v", err)
 			return tracing.TraceWithErr(span, err)
 		}
 
-		err := p.loadAggregateEventsByVersion(ctx, aggregate)
+		err := p.loadAggregateEventsByVersion(ctx, p.db, aggregate, math.MaxInt64)
 		if err != nil {
 			return err
 		}
@@ -39,9 +54,9 @@ func (p *pgEventStore) Load(ctx context.Context, aggregate Aggregate) error {
 		return nil
 	}
 
-	err = p.loadEvents(ctx, aggregate)
+	err = p.loadFullHistory(ctx, aggregate, math.MaxInt64)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	p.log.Debugf("(Load Aggregate): aggregate: %s", aggregate.String())
@@ -49,12 +64,95 @@ func (p *pgEventStore) Load(ctx context.Context, aggregate Aggregate) error {
 	return nil
 }
 
-// Save es.Aggregate events using snapshots with when given frequency
+// LoadAt load read-only aggregate state at given version using snapshot taken at or before the version
+func (p *pgEventStore) LoadAt(ctx context.Context, aggregate Aggregate, version uint64) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.LoadAt")
+	defer span.Finish()
+	span.LogFields(log.String("aggregate", aggregate.String()), log.Uint64("version", version))
+
+	if version == 0 {
+		return tracing.TraceWithErr(span, errors.Wrapf(ErrInvalidEventVersion, "aggregateID: %s, version: 0", aggregate.GetID()))
+	}
+
+	snapshot, err := p.GetSnapshot(ctx, aggregate.GetID())
+	if err != nil && !isSnapshotMissing(err) {
+		return tracing.TraceWithErr(span, err)
+	}
+
+	if snapshot != nil && snapshot.Version <= version {
+		if snapshot, ok := p.usableSnapshot(aggregate, snapshot); ok {
+			if err := serializer.Unmarshal(snapshot.State, aggregate); err != nil {
+				p.log.Errorf("(LoadAt) serializer.Unmarshal err: %v", err)
+				return tracing.TraceWithErr(span, err)
+			}
+		}
+	}
+
+	if err := p.loadFullHistory(ctx, aggregate, version); err != nil {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "loadFullHistory"))
+	}
+
+	if aggregate.GetVersion() != version {
+		return tracing.TraceWithErr(span, errors.Wrapf(ErrInvalidEventVersion, "aggregateID: %s, version: %d, stream version: %d", aggregate.GetID(), version, aggregate.GetVersion()))
+	}
+
+	markReadOnly(aggregate)
+	p.log.Debugf("(LoadAt) aggregate: %s", aggregate.String())
+	span.LogFields(log.String("aggregate with events", aggregate.String()))
+	return nil
+}
+
+// LoadAsOf load read-only aggregate state including events saved until given time
+func (p *pgEventStore) LoadAsOf(ctx context.Context, aggregate Aggregate, asOf time.Time) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.LoadAsOf")
+	defer span.Finish()
+	span.LogFields(log.String("aggregate", aggregate.String()), log.String("asOf", asOf.String()))
+
+	var version uint64
+	if err := p.db.QueryRow(ctx, getVersionAsOfQuery, aggregate.GetID(), asOf).Scan(&version); err != nil {
+		p.log.Errorf("(LoadAsOf) db.QueryRow err: %v", err)
+		return tracing.TraceWithErr(span, errors.Wrap(err, "db.QueryRow"))
+	}
+
+	// events saved until asOf may be archived already
+	if p.archive != nil {
+		archiveVersion, err := p.archiveVersionAsOf(ctx, aggregate.GetID(), asOf)
+		if err != nil {
+			return tracing.TraceWithErr(span, errors.Wrap(err, "archiveVersionAsOf"))
+		}
+		if archiveVersion > version {
+			version = archiveVersion
+		}
+	}
+
+	if version == 0 {
+		return tracing.TraceWithErr(span, errors.Wrapf(ErrAggregateNotFound, "aggregateID: %s, asOf: %s", aggregate.GetID(), asOf))
+	}
+
+	return p.LoadAt(ctx, aggregate, version)
+}
+
+func markReadOnly(aggregate Aggregate) {
+	if readOnly, ok := aggregate.(ReadOnly); ok {
+		readOnly.MarkReadOnly()
+	}
+}
+
+func isReadOnly(aggregate Aggregate) bool {
+	readOnly, ok := aggregate.(ReadOnly)
+	return ok && readOnly.IsReadOnly()
+}
+
+// Save es.Aggregate events and take snapshot when configured SnapshotStrategy decide so
 func (p *pgEventStore) Save(ctx context.Context, aggregate Aggregate) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.Save")
 	defer span.Finish()
 	span.LogFields(log.String("aggregate", aggregate.String()))
 
+	if isReadOnly(aggregate) {
+		return tracing.TraceWithErr(span, errors.Wrapf(ErrReadOnlyAggregate, "aggregateID: %s", aggregate.GetID()))
+	}
+
 	// Check if any event not create then dont need save any thing
 	if len(aggregate.GetChanges()) == 0 {
 		p.log.Debug("(Save) aggregate.GetChanges()) == 0")
@@ -85,6 +183,12 @@ func (p *pgEventStore) Save(ctx context.Context, aggregate Aggregate) error {
 	changes := aggregate.GetChanges()
 	events := make([]Event, 0, len(changes))
 
+	// all events of one save share correlation id, new flow is started if context has none
+	metadataCtx := ctx
+	if CorrelationIDFromContext(ctx) == "" {
+		metadataCtx = WithCorrelationID(ctx, uuid.NewV4().String())
+	}
+
 	// serialize all event with error tracing
 	for i := range changes {
 		event, err := p.serializer.SerializeEvent(aggregate, changes[i])
@@ -93,29 +197,67 @@ func (p *pgEventStore) Save(ctx context.Context, aggregate Aggregate) error {
 			return tracing.TraceWithErr(span, errors.Wrap(err, "serializer.SerializeEvent"))
 		}
 
+		if err := event.setStandardMetadata(metadataCtx, p.cfg.ServiceName); err != nil {
+			p.log.Warnf("(Save) setStandardMetadata eventType: %s, err: %v", event.GetEventType(), err)
+		}
+
 		events = append(events, event)
 	}
 
-	// save event with transaction and error tracing
-	if err := p.saveEventsTx(ctx, tx, events); err != nil {
-		return tracing.TraceWithErr(span, errors.Wrap(err, "saveEventTx"))
+	// store idempotency key with the events, repeated command returns the original result instead of new events
+	if idempotencyKey := IdempotencyKeyFromContext(ctx); idempotencyKey != "" {
+		if err := p.saveIdempotencyKeyTx(ctx, tx, idempotencyKey, aggregate); err != nil {
+			return tracing.TraceWithErr(span, err)
+		}
+	}
+
+	// save event with transaction and error tracing, aggregate was loaded at version before uncommitted changes
+	previousVersion := aggregate.GetVersion() - uint64(len(changes))
+	if err := p.appendEventsTx(ctx, tx, aggregate.GetID(), ExactVersion(previousVersion), events); err != nil {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "appendEventsTx"))
 	}
 
-	// consider aggregate version with snapshotFrequency for process Snapshot and save snapshot with transaction
-	if aggregate.GetVersion()%p.cfg.SnapshotFrequency == 0 {
+	// ask snapshot strategy and save snapshot with transaction or keep it for writing after commit
+	shouldSnapshot, err := p.cfg.snapshotStrategy().ShouldSnapshot(ctx, SnapshotContext{
+		Aggregate:       aggregate,
+		PreviousVersion: previousVersion,
+		CurrentVersion:  aggregate.GetVersion(),
+		LastSnapshot: func(ctx context.Context) (*Snapshot, error) {
+			return p.getSnapshotTx(ctx, tx, aggregate.GetID())
+		},
+	})
+	if err != nil {
+		p.log.Errorf("(Save) ShouldSnapshot err: %v", err)
+		return tracing.TraceWithErr(span, errors.Wrap(err, "ShouldSnapshot"))
+	}
+
+	var deferredSnapshot *Snapshot
+	if shouldSnapshot {
 		aggregate.ToSnapshot()
-		if err := p.saveSnapshotTx(ctx, tx, aggregate); err != nil {
+		if p.cfg.SnapshotMode == SnapshotDeferred {
+			if deferredSnapshot, err = NewSnapshotFromAggregate(aggregate); err != nil {
+				return tracing.TraceWithErr(span, errors.Wrap(err, "NewSnapshotFromAggregate"))
+			}
+		} else if err := p.saveSnapshotTx(ctx, tx, aggregate); err != nil {
 			return tracing.TraceWithErr(span, errors.Wrap(err, "saveSnapshotTx"))
 		}
 	}
 
-	// run processEvents
-	if err := p.processEvents(ctx, events); err != nil {
-		return tracing.TraceWithErr(span, errors.Wrap(err, "processEvents"))
+	// run processEvents or write them to the outbox in the same transaction
+	if err := p.processEventsTx(ctx, tx, events); err != nil {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "processEventsTx"))
 	}
 
 	// trace process and commit transaction
 	p.log.Debugf("(Save Aggregate): aggregate: %s", aggregate.String())
 	span.LogFields(log.String("aggregate with events", aggregate.String()))
-	return tx.Commit(ctx)
+	if err := tx.Commit(ctx); err != nil {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "tx.Commit"))
+	}
+
+	if deferredSnapshot != nil {
+		p.deferSnapshot(ctx, deferredSnapshot)
+	}
+
+	return nil
 }
@@ -0,0 +1,110 @@
+package es
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrArchiveSegmentNotFound archive segment with given key does not exist.
+	ErrArchiveSegmentNotFound = errors.New("Archive segment not found")
+	// ErrInvalidArchiveKey archive segment key is empty or escapes the archive root.
+	ErrInvalidArchiveKey = errors.New("Invalid archive key")
+	// ErrArchiveStoreNotConfigured stream has archived events but event store has no ArchiveStore.
+	ErrArchiveStoreNotConfigured = errors.New("Archive store not configured")
+)
+
+// ArchiveStore cold storage of archived event segments.
+type ArchiveStore interface {
+	// WriteSegment store segment under key, existing segment is replaced.
+	WriteSegment(ctx context.Context, key string, data []byte) error
+
+	// ReadSegment load segment by key, returns ErrArchiveSegmentNotFound if it does not exist.
+	ReadSegment(ctx context.Context, key string) ([]byte, error)
+
+	// DeleteSegment delete segment by key, missing segment is not an error.
+	DeleteSegment(ctx context.Context, key string) error
+}
+
+type fileArchiveStore struct {
+	root string
+}
+
+// NewFileArchiveStore ArchiveStore keeping segments as files under root directory.
+func NewFileArchiveStore(root string) *fileArchiveStore {
+	return &fileArchiveStore{root: root}
+}
+
+// WriteSegment write segment to temporary file and rename it, so readers never see partial segment.
+func (s *fileArchiveStore) WriteSegment(ctx context.Context, key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return errors.Wrap(err, "os.MkdirAll")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "os.CreateTemp")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "tmp.Write")
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "tmp.Sync")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "tmp.Close")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), path), "os.Rename")
+}
+
+// ReadSegment read segment file.
+func (s *fileArchiveStore) ReadSegment(ctx context.Context, key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrapf(ErrArchiveSegmentNotFound, "key: %s", key)
+		}
+		return nil, errors.Wrap(err, "os.ReadFile")
+	}
+	return data, nil
+}
+
+// DeleteSegment remove segment file.
+func (s *fileArchiveStore) DeleteSegment(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "os.Remove")
+	}
+	return nil
+}
+
+func (s *fileArchiveStore) path(key string) (string, error) {
+	cleanKey := filepath.Clean(filepath.FromSlash(key))
+	if key == "" || filepath.IsAbs(cleanKey) || cleanKey == ".." || strings.HasPrefix(cleanKey, ".."+string(filepath.Separator)) {
+		return "", errors.Wrapf(ErrInvalidArchiveKey, "key: %s", key)
+	}
+	return filepath.Join(s.root, cleanKey), nil
+}
@@ -0,0 +1,175 @@
+package es
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+const (
+	defaultArchiverOlderThan    = 90 * 24 * time.Hour
+	defaultArchiverBatchSize    = 100
+	defaultArchiverPollInterval = 1 * time.Hour
+)
+
+// ArchiverConfig background archiver config
+type ArchiverConfig struct {
+	// OlderThan archive events saved more than OlderThan ago.
+	OlderThan time.Duration `mapstructure:"olderThan"`
+	// ClosedStreams archive all events of closed streams regardless of their age.
+	ClosedStreams bool          `mapstructure:"closedStreams"`
+	BatchSize     int           `mapstructure:"batchSize" validate:"gte=0"`
+	PollInterval  time.Duration `mapstructure:"pollInterval"`
+}
+
+// StreamArchiveStore is responsible for moving old stream events to the ArchiveStore.
+type StreamArchiveStore interface {
+	// FindArchiveCandidates find active or closed streams with events to archive, not positive limit returns ErrInvalidLimit.
+	FindArchiveCandidates(ctx context.Context, aggregateTypes []AggregateType, cutoff time.Time, includeClosed bool, limit int) ([]ArchiveCandidate, error)
+
+	// ArchiveStream archive stream events saved before cutoff, aggregate is new instance with stream id.
+	ArchiveStream(ctx context.Context, aggregate Aggregate, cutoff time.Time) (*ArchivePointer, error)
+}
+
+// Archiver periodically move events of registered aggregate types older than OlderThan,
+// or all events of closed streams, to the ArchiveStore leaving snapshot and archive pointer behind.
+type Archiver struct {
+	log   logger.Logger
+	cfg   ArchiverConfig
+	store StreamArchiveStore
+
+	mu        sync.RWMutex
+	factories map[AggregateType]func() Aggregate
+}
+
+// NewArchiver Archiver constructor.
+func NewArchiver(log logger.Logger, cfg ArchiverConfig, store StreamArchiveStore) *Archiver {
+	if cfg.OlderThan <= 0 {
+		cfg.OlderThan = defaultArchiverOlderThan
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultArchiverBatchSize
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultArchiverPollInterval
+	}
+
+	return &Archiver{
+		log:       log,
+		cfg:       cfg,
+		store:     store,
+		factories: make(map[AggregateType]func() Aggregate),
+	}
+}
+
+// RegisterAggregate register factory of empty aggregate of given type, only registered types are archived.
+func (a *Archiver) RegisterAggregate(aggregateType AggregateType, factory func() Aggregate) *Archiver {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.factories[aggregateType] = factory
+	return a
+}
+
+// Run archive streams with configured interval until context is done.
+func (a *Archiver) Run(ctx context.Context) error {
+	a.log.Infof("(Starting Archiver) olderThan: %s, closedStreams: %v, batchSize: %d, pollInterval: %s", a.cfg.OlderThan, a.cfg.ClosedStreams, a.cfg.BatchSize, a.cfg.PollInterval)
+
+	ticker := time.NewTicker(a.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		archived, err := a.ArchiveBatch(ctx)
+		if err != nil {
+			a.log.Errorf("(Archiver) ArchiveBatch err: %v", err)
+		}
+
+		// more streams wait for archiving, don't wait for next tick
+		if err == nil && archived == a.cfg.BatchSize {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			a.log.Infof("(Archiver) stopped: %v", ctx.Err())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ArchiveBatch archive one batch of candidate streams and return count of archived streams,
+// failed streams are only logged because they are found again by the next batch.
+func (a *Archiver) ArchiveBatch(ctx context.Context) (int, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Archiver.ArchiveBatch")
+	defer span.Finish()
+
+	a.mu.RLock()
+	aggregateTypes := make([]AggregateType, 0, len(a.factories))
+	for aggregateType := range a.factories {
+		aggregateTypes = append(aggregateTypes, aggregateType)
+	}
+	a.mu.RUnlock()
+
+	if len(aggregateTypes) == 0 {
+		return 0, tracing.TraceWithErr(span, errors.Wrap(ErrInvalidAggregate, "no aggregate factories registered"))
+	}
+
+	cutoff := time.Now().Add(-a.cfg.OlderThan)
+	candidates, err := a.store.FindArchiveCandidates(ctx, aggregateTypes, cutoff, a.cfg.ClosedStreams, a.cfg.BatchSize)
+	if err != nil {
+		return 0, tracing.TraceWithErr(span, errors.Wrap(err, "store.FindArchiveCandidates"))
+	}
+
+	archived := 0
+	for _, candidate := range candidates {
+		if ctx.Err() != nil {
+			return archived, ctx.Err()
+		}
+
+		streamCutoff := cutoff
+		if candidate.State == StreamClosed && a.cfg.ClosedStreams {
+			streamCutoff = time.Now()
+		}
+
+		if err := a.archiveStream(ctx, candidate, streamCutoff); err != nil {
+			a.log.Warnf("(Archiver) archiveStream aggregateID: %s, err: %v", candidate.AggregateID, err)
+			continue
+		}
+		archived++
+	}
+
+	span.LogFields(log.Int("candidates", len(candidates)), log.Int("archived", archived))
+	return archived, nil
+}
+
+func (a *Archiver) archiveStream(ctx context.Context, candidate ArchiveCandidate, cutoff time.Time) error {
+	a.mu.RLock()
+	factory, ok := a.factories[candidate.AggregateType]
+	a.mu.RUnlock()
+	if !ok {
+		return errors.Wrapf(ErrInvalidAggregate, "aggregateType: %s", candidate.AggregateType)
+	}
+
+	aggregate := factory()
+	aggregate.SetID(candidate.AggregateID)
+
+	pointer, err := a.store.ArchiveStream(ctx, aggregate, cutoff)
+	if err != nil {
+		return errors.Wrap(err, "store.ArchiveStream")
+	}
+
+	if pointer != nil {
+		a.log.Debugf("(Archiver) aggregateID: %s, segment: %s, events: %d", pointer.AggregateID, pointer.SegmentKey, pointer.EventsCount)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package es
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+// CheckpointStore is responsible for storing global position processed by named subscription.
+type CheckpointStore interface {
+	// GetCheckpoint load last processed position of subscription, 0 if subscription has no checkpoint.
+	GetCheckpoint(ctx context.Context, subscriptionID string) (uint64, error)
+
+	// SaveCheckpoint save last processed position of subscription.
+	SaveCheckpoint(ctx context.Context, subscriptionID string, position uint64) error
+}
+
+type pgCheckpointStore struct {
+	log logger.Logger
+	db  *pgxpool.Pool
+}
+
+// NewPgCheckpointStore postgres CheckpointStore constructor.
+func NewPgCheckpointStore(log logger.Logger, db *pgxpool.Pool) *pgCheckpointStore {
+	return &pgCheckpointStore{log: log, db: db}
+}
+
+// GetCheckpoint load subscription checkpoint from microservices.subscription_checkpoints
+func (c *pgCheckpointStore) GetCheckpoint(ctx context.Context, subscriptionID string) (uint64, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgCheckpointStore.GetCheckpoint")
+	defer span.Finish()
+	span.LogFields(log.String("subscriptionID", subscriptionID))
+
+	var position uint64
+	if err := c.db.QueryRow(ctx, getCheckpointQuery, subscriptionID).Scan(&position); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, nil
+		}
+		c.log.Errorf("(GetCheckpoint) db.QueryRow err: %v", err)
+		return 0, tracing.TraceWithErr(span, errors.Wrap(err, "db.QueryRow"))
+	}
+
+	return position, nil
+}
+
+// SaveCheckpoint save subscription checkpoint to microservices.subscription_checkpoints
+func (c *pgCheckpointStore) SaveCheckpoint(ctx context.Context, subscriptionID string, position uint64) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgCheckpointStore.SaveCheckpoint")
+	defer span.Finish()
+	span.LogFields(log.String("subscriptionID", subscriptionID), log.Uint64("position", position))
+
+	if _, err := c.db.Exec(ctx, saveCheckpointQuery, subscriptionID, position); err != nil {
+		c.log.Errorf("(SaveCheckpoint) db.Exec err: %v", err)
+		return tracing.TraceWithErr(span, errors.Wrap(err, "db.Exec"))
+	}
+
+	c.log.Debugf("(SaveCheckpoint) subscriptionID: %s, position: %d", subscriptionID, position)
+	return nil
+}
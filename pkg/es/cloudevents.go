@@ -0,0 +1,209 @@
+package es
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
+	"github.com/segmentio/kafka-go"
+)
+
+// CloudEventsMode CloudEvents 1.0 kafka protocol binding content mode.
+type CloudEventsMode string
+
+const (
+	// CloudEventsModeNone publish KafkaEventsBus []Event json array.
+	CloudEventsModeNone CloudEventsMode = ""
+	// CloudEventsModeStructured publish each event as application/cloudevents+json message value.
+	CloudEventsModeStructured CloudEventsMode = "structured"
+	// CloudEventsModeBinary publish each event data as message value with ce_ attribute headers.
+	CloudEventsModeBinary CloudEventsMode = "binary"
+)
+
+const (
+	cloudEventsSpecVersion       = "1.0"
+	cloudEventsStructuredContent = "application/cloudevents+json"
+	cloudEventsHeaderPrefix      = "ce_"
+	kafkaContentTypeHeader       = "content-type"
+
+	ceSpecVersion   = "specversion"
+	ceID            = "id"
+	ceSource        = "source"
+	ceType          = "type"
+	ceSubject       = "subject"
+	ceTime          = "time"
+	ceVersion       = "esversion"
+	ceSchemaVersion = "esschemaversion"
+	ceMetadata      = "esmetadata"
+)
+
+var ErrInvalidCloudEvent = errors.New("Invalid cloud event")
+
+// cloudEvent CloudEvents 1.0 json format with es extension attributes.
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      []byte          `json:"data_base64,omitempty"`
+	ESVersion       uint64          `json:"esversion"`
+	ESSchemaVersion uint32          `json:"esschemaversion,omitempty"`
+	ESMetadata      string          `json:"esmetadata,omitempty"`
+}
+
+// EncodeCloudEvent map Event to kafka message in given CloudEvents mode, EventID to id, AggregateType to source,
+// AggregateID to subject, EventType to type, Timestamp to time and Version, SchemaVersion, Metadata to extensions.
+func EncodeCloudEvent(event Event, mode CloudEventsMode) (kafka.Message, error) {
+	switch mode {
+	case CloudEventsModeBinary:
+		return kafka.Message{
+			Value: event.GetData(),
+			Headers: []kafka.Header{
+				{Key: cloudEventsHeaderPrefix + ceSpecVersion, Value: []byte(cloudEventsSpecVersion)},
+				{Key: cloudEventsHeaderPrefix + ceID, Value: []byte(event.GetEventID())},
+				{Key: cloudEventsHeaderPrefix + ceSource, Value: []byte(event.GetAggregateType())},
+				{Key: cloudEventsHeaderPrefix + ceType, Value: []byte(event.GetEventType())},
+				{Key: cloudEventsHeaderPrefix + ceSubject, Value: []byte(event.GetAggregateID())},
+				{Key: cloudEventsHeaderPrefix + ceTime, Value: []byte(event.GetTimeStamp().UTC().Format(time.RFC3339Nano))},
+				{Key: cloudEventsHeaderPrefix + ceVersion, Value: []byte(strconv.FormatUint(event.GetVersion(), 10))},
+				{Key: cloudEventsHeaderPrefix + ceSchemaVersion, Value: []byte(strconv.FormatUint(uint64(event.GetSchemaVersion()), 10))},
+				{Key: cloudEventsHeaderPrefix + ceMetadata, Value: event.GetMetadata()},
+				{Key: kafkaContentTypeHeader, Value: []byte(event.GetContentType())},
+			},
+		}, nil
+
+	case CloudEventsModeStructured:
+		ce := cloudEvent{
+			SpecVersion:     cloudEventsSpecVersion,
+			ID:              event.GetEventID(),
+			Source:          string(event.GetAggregateType()),
+			Type:            string(event.GetEventType()),
+			Subject:         event.GetAggregateID(),
+			Time:            event.GetTimeStamp().UTC(),
+			DataContentType: event.GetContentType(),
+			ESVersion:       event.GetVersion(),
+			ESSchemaVersion: event.GetSchemaVersion(),
+			ESMetadata:      string(event.GetMetadata()),
+		}
+		if ce.DataContentType == serializer.ContentTypeJSON && json.Valid(event.GetData()) {
+			ce.Data = event.GetData()
+		} else {
+			ce.DataBase64 = event.GetData()
+		}
+
+		value, err := serializer.Marshal(&ce)
+		if err != nil {
+			return kafka.Message{}, errors.Wrap(err, "serializer.Marshal")
+		}
+
+		return kafka.Message{
+			Value:   value,
+			Headers: []kafka.Header{{Key: kafkaContentTypeHeader, Value: []byte(cloudEventsStructuredContent)}},
+		}, nil
+	}
+
+	return kafka.Message{}, errors.Wrapf(ErrInvalidCloudEvent, "unknown mode: %s", mode)
+}
+
+// IsCloudEvent check if kafka message is encoded with CloudEvents binding in any mode.
+func IsCloudEvent(headers []kafka.Header) bool {
+	for _, header := range headers {
+		if header.Key == cloudEventsHeaderPrefix+ceSpecVersion {
+			return true
+		}
+		if header.Key == kafkaContentTypeHeader && strings.HasPrefix(string(header.Value), cloudEventsStructuredContent) {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeCloudEvent map CloudEvents kafka message in structured or binary mode back to Event.
+func DecodeCloudEvent(m kafka.Message) (Event, error) {
+	headers := make(map[string]string, len(m.Headers))
+	for _, header := range m.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+
+	if strings.HasPrefix(headers[kafkaContentTypeHeader], cloudEventsStructuredContent) {
+		return decodeStructuredCloudEvent(m.Value)
+	}
+
+	if headers[cloudEventsHeaderPrefix+ceSpecVersion] == "" {
+		return Event{}, errors.Wrap(ErrInvalidCloudEvent, "missing specversion")
+	}
+
+	event := Event{
+		EventID:       headers[cloudEventsHeaderPrefix+ceID],
+		AggregateType: AggregateType(headers[cloudEventsHeaderPrefix+ceSource]),
+		EventType:     EventType(headers[cloudEventsHeaderPrefix+ceType]),
+		AggregateID:   headers[cloudEventsHeaderPrefix+ceSubject],
+		Data:          m.Value,
+	}
+	if metadata := headers[cloudEventsHeaderPrefix+ceMetadata]; metadata != "" {
+		event.Metadata = []byte(metadata)
+	}
+
+	if value := headers[cloudEventsHeaderPrefix+ceTime]; value != "" {
+		timestamp, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return Event{}, errors.Wrapf(ErrInvalidCloudEvent, "time: %s", value)
+		}
+		event.Timestamp = timestamp
+	}
+
+	if value := headers[cloudEventsHeaderPrefix+ceVersion]; value != "" {
+		version, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return Event{}, errors.Wrapf(ErrInvalidCloudEvent, "esversion: %s", value)
+		}
+		event.Version = version
+	}
+
+	if value := headers[cloudEventsHeaderPrefix+ceSchemaVersion]; value != "" {
+		schemaVersion, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return Event{}, errors.Wrapf(ErrInvalidCloudEvent, "esschemaversion: %s", value)
+		}
+		event.SchemaVersion = uint32(schemaVersion)
+	}
+
+	return event, nil
+}
+
+func decodeStructuredCloudEvent(value []byte) (Event, error) {
+	var ce cloudEvent
+	if err := serializer.Unmarshal(value, &ce); err != nil {
+		return Event{}, errors.Wrap(err, "serializer.Unmarshal")
+	}
+
+	if ce.SpecVersion == "" {
+		return Event{}, errors.Wrap(ErrInvalidCloudEvent, "missing specversion")
+	}
+
+	event := Event{
+		EventID:       ce.ID,
+		AggregateType: AggregateType(ce.Source),
+		EventType:     EventType(ce.Type),
+		AggregateID:   ce.Subject,
+		Version:       ce.ESVersion,
+		SchemaVersion: ce.ESSchemaVersion,
+		Timestamp:     ce.Time,
+		Data:          []byte(ce.Data),
+	}
+	if ce.DataBase64 != nil {
+		event.Data = ce.DataBase64
+	}
+	if ce.ESMetadata != "" {
+		event.Metadata = []byte(ce.ESMetadata)
+	}
+
+	return event, nil
+}
@@ -0,0 +1,131 @@
+package es
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestCloudEventRoundTrip(t *testing.T) {
+	newEvent := func(t *testing.T, codec serializer.Codec, data []byte) Event {
+		event := Event{
+			EventID:       "event-1",
+			AggregateID:   "aggregate-1",
+			EventType:     "created",
+			AggregateType: testAggregateType,
+			Version:       3,
+			SchemaVersion: 2,
+			Data:          data,
+			Timestamp:     time.Date(2023, 5, 1, 10, 20, 30, 123456789, time.UTC),
+		}
+		if err := event.SetContentType(codec.ContentType()); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	tests := []struct {
+		name  string
+		mode  CloudEventsMode
+		codec serializer.Codec
+		data  []byte
+	}{
+		{name: "structured json", mode: CloudEventsModeStructured, codec: serializer.JSONCodec{}, data: []byte(`{"name":"a"}`)},
+		{name: "structured binary data", mode: CloudEventsModeStructured, codec: serializer.MsgPackCodec{}, data: []byte{0x81, 0xa4, 0x6e, 0x61, 0x6d, 0x65}},
+		{name: "binary json", mode: CloudEventsModeBinary, codec: serializer.JSONCodec{}, data: []byte(`{"name":"a"}`)},
+		{name: "binary protobuf", mode: CloudEventsModeBinary, codec: serializer.ProtobufCodec{}, data: []byte{0x0a, 0x01, 0x61}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := newEvent(t, tt.codec, tt.data)
+
+			message, err := EncodeCloudEvent(event, tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsCloudEvent(message.Headers) {
+				t.Fatal("IsCloudEvent() = false")
+			}
+
+			decoded, err := DecodeCloudEvent(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if decoded.GetEventID() != event.GetEventID() ||
+				decoded.GetAggregateID() != event.GetAggregateID() ||
+				decoded.GetAggregateType() != event.GetAggregateType() ||
+				decoded.GetEventType() != event.GetEventType() ||
+				decoded.GetVersion() != event.GetVersion() ||
+				decoded.GetSchemaVersion() != event.GetSchemaVersion() ||
+				!decoded.GetTimeStamp().Equal(event.GetTimeStamp()) {
+				t.Fatalf("DecodeCloudEvent() = %s, want %s", decoded.String(), event.String())
+			}
+			if !bytes.Equal(decoded.GetData(), event.GetData()) {
+				t.Fatalf("data = %q, want %q", decoded.GetData(), event.GetData())
+			}
+			if decoded.GetContentType() != tt.codec.ContentType() {
+				t.Fatalf("content type = %s, want %s", decoded.GetContentType(), tt.codec.ContentType())
+			}
+		})
+	}
+}
+
+func TestEncodeCloudEventUnknownMode(t *testing.T) {
+	if _, err := EncodeCloudEvent(Event{}, CloudEventsModeNone); !errors.Is(err, ErrInvalidCloudEvent) {
+		t.Fatalf("err = %v, want %v", err, ErrInvalidCloudEvent)
+	}
+}
+
+func TestDecodeCloudEventInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		message kafka.Message
+	}{
+		{name: "no specversion", message: kafka.Message{Value: []byte("data")}},
+		{name: "structured without specversion", message: kafka.Message{
+			Value:   []byte(`{"id":"1"}`),
+			Headers: []kafka.Header{{Key: kafkaContentTypeHeader, Value: []byte(cloudEventsStructuredContent)}},
+		}},
+		{name: "binary invalid time", message: kafka.Message{Headers: []kafka.Header{
+			{Key: cloudEventsHeaderPrefix + ceSpecVersion, Value: []byte(cloudEventsSpecVersion)},
+			{Key: cloudEventsHeaderPrefix + ceTime, Value: []byte("yesterday")},
+		}}},
+		{name: "binary invalid version", message: kafka.Message{Headers: []kafka.Header{
+			{Key: cloudEventsHeaderPrefix + ceSpecVersion, Value: []byte(cloudEventsSpecVersion)},
+			{Key: cloudEventsHeaderPrefix + ceVersion, Value: []byte("-1")},
+		}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeCloudEvent(tt.message); !errors.Is(err, ErrInvalidCloudEvent) {
+				t.Fatalf("err = %v, want %v", err, ErrInvalidCloudEvent)
+			}
+		})
+	}
+}
+
+func TestIsCloudEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []kafka.Header
+		want    bool
+	}{
+		{name: "no headers"},
+		{name: "es headers", headers: []kafka.Header{{Key: ContentTypeHeader, Value: []byte(serializer.ContentTypeJSON)}}},
+		{name: "binary", headers: []kafka.Header{{Key: cloudEventsHeaderPrefix + ceSpecVersion, Value: []byte(cloudEventsSpecVersion)}}, want: true},
+		{name: "structured with charset", headers: []kafka.Header{{Key: kafkaContentTypeHeader, Value: []byte(cloudEventsStructuredContent + "; charset=utf-8")}}, want: true},
+	}
+
+	for _, tt := range tests {
+		if got := IsCloudEvent(tt.headers); got != tt.want {
+			t.Errorf("IsCloudEvent(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -7,6 +7,8 @@ type Command interface {
 
 type BaseCommand struct {
 	AggregateID string `json:"aggregateID" validate:"required,gte=0"`
+	// IdempotencyKey deduplicate retried command with IdempotencyMiddleware.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 func NewBaseCommand(aggregateId string) BaseCommand {
@@ -16,3 +18,7 @@ func NewBaseCommand(aggregateId string) BaseCommand {
 func (bc *BaseCommand) GetAggregateID() string {
 	return bc.AggregateID
 }
+
+func (bc *BaseCommand) GetIdempotencyKey() string {
+	return bc.IdempotencyKey
+}
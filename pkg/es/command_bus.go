@@ -0,0 +1,92 @@
+package es
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CommandHandlerFunc handle dispatched Command.
+type CommandHandlerFunc func(ctx context.Context, command Command) error
+
+// CommandMiddleware wrap CommandHandlerFunc with cross-cutting behavior like validation, tracing or logging.
+type CommandMiddleware func(next CommandHandlerFunc) CommandHandlerFunc
+
+// CommandBus dispatch commands to the handler registered for the command Go type through middleware chain.
+type CommandBus struct {
+	mu          sync.RWMutex
+	handlers    map[reflect.Type]CommandHandlerFunc
+	middlewares []CommandMiddleware
+}
+
+// NewCommandBus CommandBus constructor, first middleware is the outermost one.
+func NewCommandBus(middlewares ...CommandMiddleware) *CommandBus {
+	return &CommandBus{
+		handlers:    make(map[reflect.Type]CommandHandlerFunc),
+		middlewares: middlewares,
+	}
+}
+
+// Use append middlewares to the chain.
+func (b *CommandBus) Use(middlewares ...CommandMiddleware) *CommandBus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.middlewares = append(b.middlewares, middlewares...)
+	return b
+}
+
+// RegisterCommandHandler register typed handler of command C, registering the same type twice replace the handler.
+// Example:
+//
+//	es.RegisterCommandHandler(bus, func(ctx context.Context, cmd *commands.CreateOrderCommand) error {
+//		return service.CreateOrder(ctx, cmd)
+//	})
+func RegisterCommandHandler[C Command](b *CommandBus, handler func(ctx context.Context, command C) error) *CommandBus {
+	commandType := reflect.TypeOf((*C)(nil)).Elem()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers[commandType] = func(ctx context.Context, command Command) error {
+		typedCommand, ok := command.(C)
+		if !ok {
+			return errors.Wrapf(ErrInvalidCommandType, "type: %T", command)
+		}
+		return handler(ctx, typedCommand)
+	}
+	return b
+}
+
+// Dispatch run registered handler of the command type through middleware chain.
+func (b *CommandBus) Dispatch(ctx context.Context, command Command) error {
+	if command == nil {
+		return errors.Wrap(ErrInvalidCommandType, "command is nil")
+	}
+
+	b.mu.RLock()
+	handler, ok := b.handlers[reflect.TypeOf(command)]
+	middlewares := b.middlewares
+	b.mu.RUnlock()
+
+	if !ok {
+		return errors.Wrapf(ErrInvalidCommandType, "handler not found for type: %T", command)
+	}
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler(ctx, command)
+}
+
+// CommandName name of the command Go type used in spans, logs and metrics.
+func CommandName(command Command) string {
+	t := reflect.TypeOf(command)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
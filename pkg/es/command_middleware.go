@@ -0,0 +1,72 @@
+package es
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-playground/validator"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+// CommandMetrics record result of handled command, implemented by the app specific metrics like prometheus.
+type CommandMetrics interface {
+	ObserveCommand(commandName string, duration time.Duration, err error)
+}
+
+// ValidationMiddleware validate command struct with validate tags before handler.
+func ValidationMiddleware(validate *validator.Validate) CommandMiddleware {
+	return func(next CommandHandlerFunc) CommandHandlerFunc {
+		return func(ctx context.Context, command Command) error {
+			if err := validate.StructCtx(ctx, command); err != nil {
+				return errors.Wrapf(err, "validate.StructCtx command: %s", CommandName(command))
+			}
+			return next(ctx, command)
+		}
+	}
+}
+
+// TracingMiddleware start opentracing span for handled command.
+func TracingMiddleware() CommandMiddleware {
+	return func(next CommandHandlerFunc) CommandHandlerFunc {
+		return func(ctx context.Context, command Command) error {
+			span, ctx := opentracing.StartSpanFromContext(ctx, "CommandBus."+CommandName(command))
+			defer span.Finish()
+			span.LogFields(log.String("aggregateID", command.GetAggregateID()))
+
+			return tracing.TraceWithErr(span, next(ctx, command))
+		}
+	}
+}
+
+// LoggingMiddleware log handled command with duration and error.
+func LoggingMiddleware(log logger.Logger) CommandMiddleware {
+	return func(next CommandHandlerFunc) CommandHandlerFunc {
+		return func(ctx context.Context, command Command) error {
+			start := time.Now()
+			err := next(ctx, command)
+			if err != nil {
+				log.Errorf("(CommandBus) command: %s, aggregateID: %s, time: %s, err: %v", CommandName(command), command.GetAggregateID(), time.Since(start), err)
+				return err
+			}
+
+			log.Debugf("(CommandBus) command: %s, aggregateID: %s, time: %s", CommandName(command), command.GetAggregateID(), time.Since(start))
+			return nil
+		}
+	}
+}
+
+// MetricsMiddleware record command duration and result with CommandMetrics.
+func MetricsMiddleware(metrics CommandMetrics) CommandMiddleware {
+	return func(next CommandHandlerFunc) CommandHandlerFunc {
+		return func(ctx context.Context, command Command) error {
+			start := time.Now()
+			err := next(ctx, command)
+			metrics.ObserveCommand(CommandName(command), time.Since(start), err)
+			return err
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package es
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// CompressionAlgorithm algorithm used to compress stored event data and snapshot state,
+// it is stored next to the data, so rows written without compression stay readable.
+type CompressionAlgorithm string
+
+const (
+	CompressionNone CompressionAlgorithm = ""
+	CompressionGzip CompressionAlgorithm = "gzip"
+	CompressionZstd CompressionAlgorithm = "zstd"
+)
+
+// ErrUnknownCompression stored data compressed with unsupported algorithm.
+var ErrUnknownCompression = errors.New("Unknown compression algorithm")
+
+// CompressionConfig compression of event data and snapshot state larger than Threshold bytes.
+type CompressionConfig struct {
+	Algorithm CompressionAlgorithm `json:"algorithm"`
+	Threshold int                  `json:"threshold" validate:"gte=0"`
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
+
+// compress data with configured algorithm if it reaches threshold,
+// data is kept uncompressed when compression does not make it smaller.
+func (c CompressionConfig) compress(data []byte) ([]byte, CompressionAlgorithm, error) {
+	if c.Algorithm == CompressionNone || len(data) < c.Threshold {
+		return data, CompressionNone, nil
+	}
+
+	var compressed []byte
+	switch c.Algorithm {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, CompressionNone, errors.Wrap(err, "gzip.Write")
+		}
+		if err := w.Close(); err != nil {
+			return nil, CompressionNone, errors.Wrap(err, "gzip.Close")
+		}
+		compressed = buf.Bytes()
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, CompressionNone, errors.Wrap(err, "zstd.NewWriter")
+		}
+		compressed = zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+	default:
+		return nil, CompressionNone, errors.Wrapf(ErrUnknownCompression, "algorithm: %s", c.Algorithm)
+	}
+
+	if len(compressed) >= len(data) {
+		return data, CompressionNone, nil
+	}
+	return compressed, c.Algorithm, nil
+}
+
+// decompress data stored with given algorithm.
+func decompress(data []byte, algorithm CompressionAlgorithm) ([]byte, error) {
+	switch algorithm {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip.NewReader")
+		}
+		defer r.Close()
+
+		decompressed, err := io.ReadAll(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip.Read")
+		}
+		return decompressed, nil
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, errors.Wrap(err, "zstd.NewReader")
+		}
+		decompressed, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "zstd.DecodeAll")
+		}
+		return decompressed, nil
+	default:
+		return nil, errors.Wrapf(ErrUnknownCompression, "algorithm: %s", algorithm)
+	}
+}
@@ -0,0 +1,85 @@
+package es
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	compressible := bytes.Repeat([]byte(`{"name":"compressible payload"}`), 100)
+	random := make([]byte, 2048)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		cfg           CompressionConfig
+		data          []byte
+		wantAlgorithm CompressionAlgorithm
+	}{
+		{name: "disabled", cfg: CompressionConfig{}, data: compressible, wantAlgorithm: CompressionNone},
+		{name: "gzip", cfg: CompressionConfig{Algorithm: CompressionGzip, Threshold: 256}, data: compressible, wantAlgorithm: CompressionGzip},
+		{name: "zstd", cfg: CompressionConfig{Algorithm: CompressionZstd, Threshold: 256}, data: compressible, wantAlgorithm: CompressionZstd},
+		{name: "below threshold", cfg: CompressionConfig{Algorithm: CompressionGzip, Threshold: len(compressible) + 1}, data: compressible, wantAlgorithm: CompressionNone},
+		{name: "at threshold", cfg: CompressionConfig{Algorithm: CompressionZstd, Threshold: len(compressible)}, data: compressible, wantAlgorithm: CompressionZstd},
+		{name: "gzip not smaller", cfg: CompressionConfig{Algorithm: CompressionGzip}, data: random, wantAlgorithm: CompressionNone},
+		{name: "zstd not smaller", cfg: CompressionConfig{Algorithm: CompressionZstd}, data: random, wantAlgorithm: CompressionNone},
+		{name: "empty", cfg: CompressionConfig{Algorithm: CompressionGzip}, data: []byte{}, wantAlgorithm: CompressionNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed, algorithm, err := tt.cfg.compress(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if algorithm != tt.wantAlgorithm {
+				t.Fatalf("algorithm = %q, want %q", algorithm, tt.wantAlgorithm)
+			}
+			if algorithm != CompressionNone && len(compressed) >= len(tt.data) {
+				t.Fatalf("compressed %d bytes to %d", len(tt.data), len(compressed))
+			}
+
+			decompressed, err := decompress(compressed, algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decompressed, tt.data) {
+				t.Fatal("round trip changed data")
+			}
+		})
+	}
+}
+
+func TestCompressionErrors(t *testing.T) {
+	if _, _, err := (CompressionConfig{Algorithm: "lz4"}).compress([]byte("data")); !errors.Is(err, ErrUnknownCompression) {
+		t.Fatalf("compress err = %v, want %v", err, ErrUnknownCompression)
+	}
+
+	tests := []struct {
+		name      string
+		algorithm CompressionAlgorithm
+		data      []byte
+		wantErr   error
+	}{
+		{name: "unknown algorithm", algorithm: "lz4", data: []byte("data"), wantErr: ErrUnknownCompression},
+		{name: "corrupted gzip", algorithm: CompressionGzip, data: []byte("not gzip")},
+		{name: "corrupted zstd", algorithm: CompressionZstd, data: []byte("not zstd")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decompress(tt.data, tt.algorithm)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,6 +1,36 @@
 package es
 
+import "time"
+
 // Config of es package.
 type Config struct {
 	SnapshotFrequency uint64 `json:"snapshotFrequency" validate:"required,gte=0"`
+	// UseOutbox write events to microservices.outbox in the save transaction instead of publishing them with EventBus.
+	UseOutbox bool `json:"useOutbox"`
+	// ServiceName stored as source service in the standard metadata of saved events.
+	ServiceName string `json:"serviceName"`
+	// SnapshotStrategy decide when Save takes snapshot, EveryNEvents(SnapshotFrequency) if nil.
+	SnapshotStrategy SnapshotStrategy `json:"-"`
+	// SnapshotMode write snapshot inline in the save transaction or deferred after commit.
+	SnapshotMode SnapshotMode `json:"snapshotMode"`
+	// DeferredSnapshots writer queue of SnapshotDeferred mode.
+	DeferredSnapshots DeferredSnapshotConfig `json:"deferredSnapshots"`
+	// Compression of stored event data and snapshot state.
+	Compression CompressionConfig `json:"compression"`
+	// IdempotencyRetention how long Save keeps idempotency keys, 24h if zero.
+	IdempotencyRetention time.Duration `json:"idempotencyRetention"`
+}
+
+func (c Config) snapshotStrategy() SnapshotStrategy {
+	if c.SnapshotStrategy != nil {
+		return c.SnapshotStrategy
+	}
+	return EveryNEvents(c.SnapshotFrequency)
+}
+
+func (c Config) idempotencyRetention() time.Duration {
+	if c.IdempotencyRetention > 0 {
+		return c.IdempotencyRetention
+	}
+	return defaultIdempotencyRetention
 }
@@ -0,0 +1,370 @@
+package es
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
+)
+
+const (
+	// MetadataEncryption metadata key describing encrypted subject and metadata fields of stored Event.
+	MetadataEncryption = "esEncryption"
+	// MetadataForgotten metadata key set on loaded Event whose subject key was deleted.
+	MetadataForgotten = "esForgotten"
+
+	dataKeySize            = 32
+	defaultKeyCacheTTL     = time.Minute
+	encryptedValueOverhead = 12 + 16
+)
+
+var (
+	// ErrSubjectForgotten data key of the subject was deleted, its encrypted data is unreadable.
+	ErrSubjectForgotten = errors.New("Subject forgotten")
+	// ErrInvalidCiphertext encrypted value is malformed or was encrypted with another key.
+	ErrInvalidCiphertext = errors.New("Invalid ciphertext")
+	// ErrCryptoShredderNotConfigured encrypted data is read without CryptoShredder.
+	ErrCryptoShredderNotConfigured = errors.New("Crypto shredder not configured")
+)
+
+// KeyProvider store of per-subject data keys used for crypto-shredding.
+type KeyProvider interface {
+	// GetOrCreateKey load data key of the subject, creating new one if subject has no key yet,
+	// returns ErrSubjectForgotten if the subject key was deleted.
+	GetOrCreateKey(ctx context.Context, subjectID string) ([]byte, error)
+
+	// GetKey load data key of the subject, returns ErrSubjectForgotten if there is no key.
+	GetKey(ctx context.Context, subjectID string) ([]byte, error)
+
+	// DeleteKey delete data key of the subject, making all its encrypted data unreadable.
+	DeleteKey(ctx context.Context, subjectID string) error
+}
+
+// ForgottenEvent raised to the aggregate instead of deserialized event when event subject was forgotten,
+// aggregate When method should ignore it or reset personal data it holds.
+type ForgottenEvent struct {
+	Event Event
+}
+
+type encryptionMetadata struct {
+	SubjectID string   `json:"subjectId"`
+	Fields    []string `json:"fields,omitempty"`
+}
+
+type cachedKey struct {
+	key     []byte
+	expires time.Time
+}
+
+// CryptoShredder encrypt Event data and selected metadata fields with per-subject data key,
+// deleting the subject key with Forget makes all its events unreadable, loaded events are then marked as forgotten.
+// Stored events, outbox records and snapshot state are encrypted, events published directly with EventBus stay plain.
+type CryptoShredder struct {
+	keys            KeyProvider
+	subject         func(event Event) string
+	snapshotSubject func(aggregateID string, aggregateType AggregateType) string
+	metadataFields  []string
+	cacheTTL        time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedKey
+	// invalidations count of InvalidateKey calls, key loaded before one of them is not cached
+	invalidations uint64
+}
+
+// CryptoShredderOption optional CryptoShredder behavior.
+type CryptoShredderOption func(c *CryptoShredder)
+
+// WithSubjectFunc choose subject of the event data key, events with empty subject are not encrypted,
+// default subject is the AggregateID.
+func WithSubjectFunc(subject func(event Event) string) CryptoShredderOption {
+	return func(c *CryptoShredder) {
+		c.subject = subject
+	}
+}
+
+// WithSnapshotSubjectFunc choose subject of the snapshot state key, snapshots with empty subject are not encrypted,
+// default subject is the AggregateID. Set it when WithSubjectFunc maps aggregate events to another subject,
+// so Forget of that subject makes the snapshot unreadable too.
+func WithSnapshotSubjectFunc(subject func(aggregateID string, aggregateType AggregateType) string) CryptoShredderOption {
+	return func(c *CryptoShredder) {
+		c.snapshotSubject = subject
+	}
+}
+
+// WithEncryptedMetadataFields encrypt given top level metadata fields together with event data.
+func WithEncryptedMetadataFields(fields ...string) CryptoShredderOption {
+	return func(c *CryptoShredder) {
+		c.metadataFields = fields
+	}
+}
+
+// WithKeyCacheTTL cache loaded data keys for given duration, zero disables cache.
+func WithKeyCacheTTL(ttl time.Duration) CryptoShredderOption {
+	return func(c *CryptoShredder) {
+		c.cacheTTL = ttl
+	}
+}
+
+// NewCryptoShredder CryptoShredder constructor.
+func NewCryptoShredder(keys KeyProvider, opts ...CryptoShredderOption) *CryptoShredder {
+	c := &CryptoShredder{
+		keys:     keys,
+		subject:  func(event Event) string { return event.GetAggregateID() },
+		cacheTTL: defaultKeyCacheTTL,
+		cache:    make(map[string]cachedKey),
+
+		snapshotSubject: func(aggregateID string, aggregateType AggregateType) string { return aggregateID },
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Forget delete subject data key, events of the subject are loaded as forgotten afterwards.
+// Only the local key cache is cleared, other instances keep decrypting with cached key for up to key cache TTL
+// unless InvalidateKey is called on them, e.g. from a handler of the app specific "subject forgotten" event.
+func (c *CryptoShredder) Forget(ctx context.Context, subjectID string) error {
+	// key is deleted before cache is cleared, so concurrent load can not cache it again
+	if err := c.keys.DeleteKey(ctx, subjectID); err != nil {
+		return err
+	}
+
+	c.InvalidateKey(subjectID)
+	return nil
+}
+
+// InvalidateKey remove subject data key from the local cache, next use loads it from KeyProvider.
+func (c *CryptoShredder) InvalidateKey(subjectID string) {
+	c.mu.Lock()
+	delete(c.cache, subjectID)
+	c.invalidations++
+	c.mu.Unlock()
+}
+
+// Encrypt return encrypted data and metadata of the event, unchanged if event has no subject.
+func (c *CryptoShredder) Encrypt(ctx context.Context, event Event, data []byte) ([]byte, []byte, error) {
+	subjectID := c.subject(event)
+	if subjectID == "" {
+		return data, event.GetMetadata(), nil
+	}
+
+	key, err := c.key(ctx, subjectID, true)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "subjectID: %s", subjectID)
+	}
+
+	encryptedData, err := seal(key, data, subjectID)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "seal data")
+	}
+
+	metadata, err := metadataFields(event.GetMetadata())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	em := encryptionMetadata{SubjectID: subjectID}
+	for _, field := range c.metadataFields {
+		value, ok := metadata[field]
+		if !ok {
+			continue
+		}
+		encryptedValue, err := seal(key, value, subjectID)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "seal metadata field: %s", field)
+		}
+		if metadata[field], err = serializer.Marshal(encryptedValue); err != nil {
+			return nil, nil, errors.Wrap(err, "serializer.Marshal")
+		}
+		em.Fields = append(em.Fields, field)
+	}
+
+	if metadata[MetadataEncryption], err = serializer.Marshal(em); err != nil {
+		return nil, nil, errors.Wrap(err, "serializer.Marshal")
+	}
+
+	encryptedMetadata, err := serializer.Marshal(metadata)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "serializer.Marshal")
+	}
+
+	return encryptedData, encryptedMetadata, nil
+}
+
+// Decrypt decrypt loaded event data and metadata in place,
+// if subject key was deleted data and encrypted metadata fields are removed and event is marked as forgotten.
+func (c *CryptoShredder) Decrypt(ctx context.Context, event *Event) error {
+	var em *encryptionMetadata
+	if err := event.GetMetadataField(MetadataEncryption, &em); err != nil {
+		return errors.Wrap(err, "GetMetadataField")
+	}
+	if em == nil {
+		return nil
+	}
+
+	metadata, err := metadataFields(event.GetMetadata())
+	if err != nil {
+		return err
+	}
+	delete(metadata, MetadataEncryption)
+
+	key, err := c.key(ctx, em.SubjectID, false)
+	if err != nil && !errors.Is(err, ErrSubjectForgotten) {
+		return errors.Wrapf(err, "subjectID: %s", em.SubjectID)
+	}
+
+	if errors.Is(err, ErrSubjectForgotten) {
+		for _, field := range em.Fields {
+			metadata[field] = json.RawMessage("null")
+		}
+		metadata[MetadataForgotten] = json.RawMessage("true")
+		event.Data = nil
+		return event.SetMetadata(metadata)
+	}
+
+	if event.Data, err = open(key, event.GetData(), em.SubjectID); err != nil {
+		return errors.Wrap(err, "open data")
+	}
+
+	for _, field := range em.Fields {
+		var encryptedValue []byte
+		if err := serializer.Unmarshal(metadata[field], &encryptedValue); err != nil {
+			return errors.Wrapf(err, "metadata field: %s", field)
+		}
+		if metadata[field], err = open(key, encryptedValue, em.SubjectID); err != nil {
+			return errors.Wrapf(err, "open metadata field: %s", field)
+		}
+	}
+
+	return event.SetMetadata(metadata)
+}
+
+// EncryptSnapshot return encrypted snapshot state and its subject, unchanged state and empty subject if snapshot has no subject,
+// returns ErrSubjectForgotten if the subject was forgotten.
+func (c *CryptoShredder) EncryptSnapshot(ctx context.Context, snapshot *Snapshot, state []byte) ([]byte, string, error) {
+	subjectID := c.snapshotSubject(snapshot.ID, snapshot.Type)
+	if subjectID == "" {
+		return state, "", nil
+	}
+
+	key, err := c.key(ctx, subjectID, true)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "subjectID: %s", subjectID)
+	}
+
+	encryptedState, err := seal(key, state, subjectID)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "seal snapshot state")
+	}
+	return encryptedState, subjectID, nil
+}
+
+// DecryptSnapshot decrypt snapshot state encrypted by EncryptSnapshot, returns ErrSubjectForgotten if the subject key was deleted.
+func (c *CryptoShredder) DecryptSnapshot(ctx context.Context, subjectID string, state []byte) ([]byte, error) {
+	key, err := c.key(ctx, subjectID, false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "subjectID: %s", subjectID)
+	}
+
+	plainState, err := open(key, state, subjectID)
+	if err != nil {
+		return nil, errors.Wrap(err, "open snapshot state")
+	}
+	return plainState, nil
+}
+
+func (c *CryptoShredder) key(ctx context.Context, subjectID string, create bool) ([]byte, error) {
+	var invalidations uint64
+	if c.cacheTTL > 0 {
+		c.mu.Lock()
+		cached, ok := c.cache[subjectID]
+		invalidations = c.invalidations
+		c.mu.Unlock()
+		if ok && time.Now().Before(cached.expires) {
+			return cached.key, nil
+		}
+	}
+
+	var key []byte
+	var err error
+	if create {
+		key, err = c.keys.GetOrCreateKey(ctx, subjectID)
+	} else {
+		key, err = c.keys.GetKey(ctx, subjectID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if c.cacheTTL > 0 {
+		c.mu.Lock()
+		// key loaded concurrently with InvalidateKey may be already deleted
+		if c.invalidations == invalidations {
+			c.cache[subjectID] = cachedKey{key: key, expires: time.Now().Add(c.cacheTTL)}
+		}
+		c.mu.Unlock()
+	}
+	return key, nil
+}
+
+// newDataKey generate random AES-256 key.
+func newDataKey() ([]byte, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errors.Wrap(err, "rand.Read")
+	}
+	return key, nil
+}
+
+// seal encrypt plaintext with AES-GCM, nonce is prepended to the ciphertext.
+func seal(key, plaintext []byte, additionalData string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "rand.Read")
+	}
+	return gcm.Seal(nonce, nonce, plaintext, []byte(additionalData)), nil
+}
+
+// open decrypt ciphertext created by seal.
+func open(key, ciphertext []byte, additionalData string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < encryptedValueOverhead {
+		return nil, ErrInvalidCiphertext
+	}
+
+	plaintext, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], []byte(additionalData))
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidCiphertext, err.Error())
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "aes.NewCipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "cipher.NewGCM")
+	}
+	return gcm, nil
+}
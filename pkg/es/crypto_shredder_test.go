@@ -0,0 +1,244 @@
+package es
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type memoryKeyProvider struct {
+	mu        sync.Mutex
+	keys      map[string][]byte
+	forgotten map[string]bool
+}
+
+func newMemoryKeyProvider() *memoryKeyProvider {
+	return &memoryKeyProvider{keys: make(map[string][]byte), forgotten: make(map[string]bool)}
+}
+
+func (p *memoryKeyProvider) GetOrCreateKey(ctx context.Context, subjectID string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.forgotten[subjectID] {
+		return nil, ErrSubjectForgotten
+	}
+	if key, ok := p.keys[subjectID]; ok {
+		return key, nil
+	}
+
+	key, err := newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	p.keys[subjectID] = key
+	return key, nil
+}
+
+func (p *memoryKeyProvider) GetKey(ctx context.Context, subjectID string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys[subjectID]
+	if !ok {
+		return nil, ErrSubjectForgotten
+	}
+	return key, nil
+}
+
+func (p *memoryKeyProvider) DeleteKey(ctx context.Context, subjectID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.keys, subjectID)
+	p.forgotten[subjectID] = true
+	return nil
+}
+
+func TestSealOpen(t *testing.T) {
+	key, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := seal(key, []byte("personal data"), "subject-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tests := []struct {
+		name           string
+		key            []byte
+		ciphertext     []byte
+		additionalData string
+		wantErr        error
+	}{
+		{name: "round trip", key: key, ciphertext: sealed, additionalData: "subject-1"},
+		{name: "another key", key: otherKey, ciphertext: sealed, additionalData: "subject-1", wantErr: ErrInvalidCiphertext},
+		{name: "another subject", key: key, ciphertext: sealed, additionalData: "subject-2", wantErr: ErrInvalidCiphertext},
+		{name: "tampered", key: key, ciphertext: tampered, additionalData: "subject-1", wantErr: ErrInvalidCiphertext},
+		{name: "truncated", key: key, ciphertext: sealed[:encryptedValueOverhead-1], additionalData: "subject-1", wantErr: ErrInvalidCiphertext},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext, err := open(tt.key, tt.ciphertext, tt.additionalData)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plaintext) != "personal data" {
+				t.Fatalf("open() = %q", plaintext)
+			}
+		})
+	}
+}
+
+func TestSealNonce(t *testing.T) {
+	key, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != dataKeySize {
+		t.Fatalf("key size = %d, want %d", len(key), dataKeySize)
+	}
+
+	first, err := seal(key, []byte("data"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := seal(key, []byte("data"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, second) {
+		t.Fatal("seal reused nonce")
+	}
+}
+
+func TestCryptoShredderEncryptDecrypt(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name          string
+		forget        bool
+		wantForgotten bool
+	}{
+		{name: "known subject"},
+		{name: "forgotten subject", forget: true, wantForgotten: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shredder := NewCryptoShredder(newMemoryKeyProvider(), WithEncryptedMetadataFields("email"), WithKeyCacheTTL(time.Minute))
+
+			event := Event{AggregateID: "subject-1", EventType: "created"}
+			if err := event.SetMetadata(map[string]string{"email": "user@example.com", "source": "test"}); err != nil {
+				t.Fatal(err)
+			}
+
+			data, metadata, err := shredder.Encrypt(ctx, event, []byte(`{"name":"a"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(data, []byte("name")) || bytes.Contains(metadata, []byte("user@example.com")) {
+				t.Fatal("Encrypt left plain data")
+			}
+			event.Data, event.Metadata = data, metadata
+			if !event.isEncrypted() {
+				t.Fatal("isEncrypted() = false")
+			}
+
+			if tt.forget {
+				if err := shredder.Forget(ctx, "subject-1"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := shredder.Decrypt(ctx, &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.IsForgotten() != tt.wantForgotten {
+				t.Fatalf("IsForgotten() = %v, want %v", event.IsForgotten(), tt.wantForgotten)
+			}
+
+			var email, source string
+			if err := event.GetMetadataField("email", &email); err != nil {
+				t.Fatal(err)
+			}
+			if err := event.GetMetadataField("source", &source); err != nil {
+				t.Fatal(err)
+			}
+			if source != "test" {
+				t.Fatalf("source = %q, want plain field kept", source)
+			}
+
+			if tt.wantForgotten {
+				if event.GetData() != nil || email != "" {
+					t.Fatalf("forgotten event kept data %q, email %q", event.GetData(), email)
+				}
+				return
+			}
+			if string(event.GetData()) != `{"name":"a"}` || email != "user@example.com" {
+				t.Fatalf("Decrypt() data %q, email %q", event.GetData(), email)
+			}
+		})
+	}
+}
+
+func TestCryptoShredderSnapshot(t *testing.T) {
+	ctx := context.Background()
+	shredder := NewCryptoShredder(newMemoryKeyProvider())
+	snapshot := &Snapshot{ID: "subject-1", Type: testAggregateType}
+
+	state, subjectID, err := shredder.EncryptSnapshot(ctx, snapshot, []byte("state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainState, err := shredder.DecryptSnapshot(ctx, subjectID, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plainState) != "state" {
+		t.Fatalf("DecryptSnapshot() = %q", plainState)
+	}
+
+	if err := shredder.Forget(ctx, subjectID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shredder.DecryptSnapshot(ctx, subjectID, state); !errors.Is(err, ErrSubjectForgotten) {
+		t.Fatalf("err = %v, want %v", err, ErrSubjectForgotten)
+	}
+	if _, _, err := shredder.EncryptSnapshot(ctx, snapshot, []byte("state")); !errors.Is(err, ErrSubjectForgotten) {
+		t.Fatalf("err = %v, want %v", err, ErrSubjectForgotten)
+	}
+}
+
+func TestCryptoShredderWithoutSubject(t *testing.T) {
+	shredder := NewCryptoShredder(newMemoryKeyProvider(), WithSubjectFunc(func(event Event) string { return "" }))
+	event := Event{AggregateID: "subject-1"}
+
+	data, metadata, err := shredder.Encrypt(context.Background(), event, []byte("plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "plain" || metadata != nil {
+		t.Fatalf("Encrypt() = %q, %q, want unchanged", data, metadata)
+	}
+}
@@ -10,4 +10,39 @@ var (
 	ErrInvalidAggregate    = errors.New("Invalid aggregate")
 	ErrInvalidAggregateID  = errors.New("Invalid aggregateid")
 	ErrInvalidEventVersion = errors.New("Invalid event version")
+	ErrConcurrencyConflict = errors.New("Concurrency conflict")
+	ErrEmptyPurgeFilter    = errors.New("Empty purge filter")
+	ErrReadOnlyAggregate   = errors.New("Read only aggregate")
+	// ErrReadAllNotSettled event writers did not finish in time, ReadAll can not tell if gaps of $all will be filled.
+	ErrReadAllNotSettled = errors.New("ReadAll not settled")
+	// ErrInvalidLimit batch read limit is not positive.
+	ErrInvalidLimit = errors.New("Invalid limit")
 )
+
+// concurrencyConflictError ErrConcurrencyConflict caused by database error, errors.Is matches both of them.
+type concurrencyConflictError struct {
+	cause error
+}
+
+func newConcurrencyConflictError(cause error) error {
+	return &concurrencyConflictError{cause: cause}
+}
+
+func (e *concurrencyConflictError) Error() string {
+	return ErrConcurrencyConflict.Error() + ": " + e.cause.Error()
+}
+
+// Is match ErrConcurrencyConflict.
+func (e *concurrencyConflictError) Is(target error) bool {
+	return target == ErrConcurrencyConflict
+}
+
+// Unwrap return database error.
+func (e *concurrencyConflictError) Unwrap() error {
+	return e.cause
+}
+
+// Cause return database error for errors.Cause.
+func (e *concurrencyConflictError) Cause() error {
+	return e.cause
+}
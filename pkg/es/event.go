@@ -1,13 +1,21 @@
 package es
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
 	uuid "github.com/satori/go.uuid"
 )
 
+const (
+	// MetadataContentType metadata key of the Event data codec content type.
+	MetadataContentType = "contentType"
+)
+
 // EventType is the type of any event, used as its unique identifier.
 type EventType string
 
@@ -23,6 +31,8 @@ type Event struct {
 	Data          []byte
 	Metadata      []byte
 	Timestamp     time.Time
+	Position      uint64
+	SchemaVersion uint32
 }
 
 // NewBaseEvent new base Event constructor with configured EventID, Aggregate properties and Timestamp.
@@ -87,6 +97,41 @@ func (e *Event) SetJsonData(data interface{}) error {
 	return nil
 }
 
+// EncodeData serialize data with given codec, set it attached to the Event and record codec content type in metadata.
+func (e *Event) EncodeData(data interface{}, codec serializer.Codec) error {
+	dataBytes, err := codec.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	e.Data = dataBytes
+	return e.SetContentType(codec.ContentType())
+}
+
+// DecodeData unmarshal data attached to the Event with the codec recorded in metadata.
+func (e *Event) DecodeData(data interface{}) error {
+	codec, err := serializer.GetCodec(e.GetContentType())
+	if err != nil {
+		return err
+	}
+
+	return codec.Unmarshal(e.GetData(), data)
+}
+
+// GetContentType content type of the Event data codec recorded in metadata, json if not recorded.
+func (e *Event) GetContentType() string {
+	var contentType string
+	if err := e.GetMetadataField(MetadataContentType, &contentType); err != nil || contentType == "" {
+		return serializer.ContentTypeJSON
+	}
+	return contentType
+}
+
+// SetContentType record content type of the Event data codec in metadata.
+func (e *Event) SetContentType(contentType string) error {
+	return e.SetMetadataField(MetadataContentType, contentType)
+}
+
 // GetEventType returns the EventType of the event.
 func (e *Event) GetEventType() EventType {
 	return e.EventType
@@ -112,6 +157,21 @@ func (e *Event) GetVersion() uint64 {
 	return e.Version
 }
 
+// GetPosition is the global position of the Event in the $all stream, set for events loaded from the store.
+func (e *Event) GetPosition() uint64 {
+	return e.Position
+}
+
+// GetSchemaVersion is the schema version of the Event payload, used for upcasting of old events.
+func (e *Event) GetSchemaVersion() uint32 {
+	return e.SchemaVersion
+}
+
+// SetSchemaVersion set the schema version of the Event payload.
+func (e *Event) SetSchemaVersion(schemaVersion uint32) {
+	e.SchemaVersion = schemaVersion
+}
+
 // SetVersion set the version of the Aggregate.
 func (e *Event) SetVersion(aggregateVersion uint64) {
 	e.Version = aggregateVersion
@@ -138,6 +198,67 @@ func (e *Event) GetJsonMetadata(metaData interface{}) error {
 	return serializer.Unmarshal(e.GetMetadata(), metaData)
 }
 
+// GetMetadataField unmarshal single field of json object metadata, value is unchanged if field is missing or null.
+func (e *Event) GetMetadataField(key string, value interface{}) error {
+	if len(e.GetMetadata()) == 0 {
+		return nil
+	}
+
+	metadata := make(map[string]json.RawMessage)
+	if err := serializer.Unmarshal(e.GetMetadata(), &metadata); err != nil {
+		return errors.Wrap(err, "metadata is not json object")
+	}
+
+	// null field is decoded as empty raw message
+	field, ok := metadata[key]
+	if !ok || len(field) == 0 {
+		return nil
+	}
+	return serializer.Unmarshal(field, value)
+}
+
+// SetMetadataField set single field of json object metadata keeping other fields.
+func (e *Event) SetMetadataField(key string, value interface{}) error {
+	metadata := make(map[string]json.RawMessage)
+	if len(e.GetMetadata()) > 0 {
+		if err := serializer.Unmarshal(e.GetMetadata(), &metadata); err != nil {
+			return errors.Wrap(err, "metadata is not json object")
+		}
+		if metadata == nil {
+			metadata = make(map[string]json.RawMessage)
+		}
+	}
+
+	fieldBytes, err := serializer.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	metadata[key] = fieldBytes
+	return e.SetMetadata(metadata)
+}
+
+// IsForgotten true if event subject was forgotten by CryptoShredder, event Data is nil then.
+func (e *Event) IsForgotten() bool {
+	if !bytes.Contains(e.GetMetadata(), []byte(MetadataForgotten)) {
+		return false
+	}
+
+	var forgotten bool
+	_ = e.GetMetadataField(MetadataForgotten, &forgotten)
+	return forgotten
+}
+
+// isEncrypted true if event data was encrypted by CryptoShredder and is not decrypted yet.
+func (e *Event) isEncrypted() bool {
+	if !bytes.Contains(e.GetMetadata(), []byte(MetadataEncryption)) {
+		return false
+	}
+
+	var em *encryptionMetadata
+	return e.GetMetadataField(MetadataEncryption, &em) == nil && em != nil
+}
+
 // GetString A string representation of the Event.
 func (e *Event) GetString() string {
 	return fmt.Sprintf("event: %+v", e)
@@ -1,15 +1,24 @@
 package es
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // AggregateStore is responsible for loading and saving Aggregate.
 type AggregateStore interface {
 	// Load loads the most recent version of an aggregate to provided into params aggregate with a type and id.
 	Load(ctx context.Context, aggregate Aggregate) error
 
-	// Save saves the uncommitted events for an aggregate.
+	// Save saves the uncommitted events for an aggregate, returns DuplicateCommandError if context idempotency key was already saved.
 	Save(ctx context.Context, aggregate Aggregate) error
 
+	// LoadAt loads read-only aggregate state at the given version.
+	LoadAt(ctx context.Context, aggregate Aggregate, version uint64) error
+
+	// LoadAsOf loads read-only aggregate state including events saved until the given time.
+	LoadAsOf(ctx context.Context, aggregate Aggregate, asOf time.Time) error
+
 	// Exists check aggregate exists by id.
 	Exists(ctx context.Context, aggregateID string) (bool, error)
 
@@ -23,8 +32,69 @@ type EventStore interface {
 	// SaveEvents appends all events in the Event stream to the store.
 	SaveEvents(ctx context.Context, events []Event) error
 
-	// LoadEvents loads all events for the Aggregate id from the stroe.
+	// AppendEvents appends events to the Aggregate stream only if the stream is at the expected version.
+	AppendEvents(ctx context.Context, aggregateID string, expectedVersion ExpectedVersion, events []Event) error
+
+	// LoadEvents loads all events for the Aggregate id from the stroe, archived events are read from ArchiveStore.
 	LoadEvents(ctx context.Context, aggregateID string) ([]Event, error)
+
+	// ReadAll loads up to limit events of all aggregates with position greater than fromPosition in position order,
+	// returned events are final, no event with lower position is committed after them.
+	// Archived events are not in the $all stream, so replays from ReadAll skip archived history.
+	// Stream lifecycle events (tombstones) are included with version 0.
+	// Not positive limit returns ErrInvalidLimit.
+	ReadAll(ctx context.Context, fromPosition uint64, limit int, filter ReadAllFilter) ([]Event, error)
+
+	// GetLastPosition loads position of the last event in the $all stream, 0 if store is empty.
+	GetLastPosition(ctx context.Context) (uint64, error)
+}
+
+// ReadAllFilter filter events of the global $all stream, empty fields match any value.
+type ReadAllFilter struct {
+	AggregateTypes []AggregateType
+	EventTypes     []EventType
+	// From include events stored at or after From.
+	From time.Time
+	// To include events stored before To.
+	To time.Time
+}
+
+func (f ReadAllFilter) from() *time.Time {
+	if f.From.IsZero() {
+		return nil
+	}
+	return &f.From
+}
+
+func (f ReadAllFilter) to() *time.Time {
+	if f.To.IsZero() {
+		return nil
+	}
+	return &f.To
+}
+
+func (f ReadAllFilter) aggregateTypes() []string {
+	if len(f.AggregateTypes) == 0 {
+		return nil
+	}
+
+	aggregateTypes := make([]string, 0, len(f.AggregateTypes))
+	for _, aggregateType := range f.AggregateTypes {
+		aggregateTypes = append(aggregateTypes, string(aggregateType))
+	}
+	return aggregateTypes
+}
+
+func (f ReadAllFilter) eventTypes() []string {
+	if len(f.EventTypes) == 0 {
+		return nil
+	}
+
+	eventTypes := make([]string, 0, len(f.EventTypes))
+	for _, eventType := range f.EventTypes {
+		eventTypes = append(eventTypes, string(eventType))
+	}
+	return eventTypes
 }
 
 // SnapshotStore is an interface for an event sourcing Snapshot store.
@@ -34,4 +104,7 @@ type SnapshotStore interface {
 
 	// GetSnapshot load aggregate snapshot.
 	GetSnapshot(ctx context.Context, id string) (*Snapshot, error)
+
+	// PurgeSnapshots delete snapshots matching filter and return number of deleted snapshots.
+	PurgeSnapshots(ctx context.Context, filter SnapshotPurgeFilter) (int64, error)
 }
@@ -0,0 +1,194 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+// Standard metadata keys filled by Save from context.Context.
+const (
+	MetadataCorrelationID = "correlationId"
+	MetadataCausationID   = "causationId"
+	MetadataActor         = "actor"
+	MetadataTenantID      = "tenantId"
+	MetadataSourceService = "sourceService"
+	MetadataTraceContext  = "traceContext"
+)
+
+type metadataContextKey string
+
+const (
+	correlationIDContextKey metadataContextKey = MetadataCorrelationID
+	causationIDContextKey   metadataContextKey = MetadataCausationID
+	actorContextKey         metadataContextKey = MetadataActor
+	tenantIDContextKey      metadataContextKey = MetadataTenantID
+)
+
+// WithCorrelationID return context with id of the whole business flow, Save generates new one if it is missing.
+func WithCorrelationID(ctx context.Context, correlationID string) context.Context {
+	return context.WithValue(ctx, correlationIDContextKey, correlationID)
+}
+
+// WithCausationID return context with id of the command or event which caused saved events.
+func WithCausationID(ctx context.Context, causationID string) context.Context {
+	return context.WithValue(ctx, causationIDContextKey, causationID)
+}
+
+// WithActor return context with user or system actor on whose behalf events are saved.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey, actor)
+}
+
+// WithTenantID return context with tenant of saved events.
+func WithTenantID(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantIDContextKey, tenantID)
+}
+
+// CorrelationIDFromContext correlation id set by WithCorrelationID.
+func CorrelationIDFromContext(ctx context.Context) string {
+	return contextString(ctx, correlationIDContextKey)
+}
+
+// CausationIDFromContext causation id set by WithCausationID.
+func CausationIDFromContext(ctx context.Context) string {
+	return contextString(ctx, causationIDContextKey)
+}
+
+// ActorFromContext actor set by WithActor.
+func ActorFromContext(ctx context.Context) string {
+	return contextString(ctx, actorContextKey)
+}
+
+// TenantIDFromContext tenant id set by WithTenantID.
+func TenantIDFromContext(ctx context.Context) string {
+	return contextString(ctx, tenantIDContextKey)
+}
+
+// ContextFromEvent return context for handling the event in projections or process managers,
+// events saved with it keep correlation id, actor and tenant of the event and are caused by it.
+func ContextFromEvent(ctx context.Context, event Event) context.Context {
+	correlationID := event.GetCorrelationID()
+	if correlationID == "" {
+		correlationID = event.GetEventID()
+	}
+	ctx = WithCorrelationID(ctx, correlationID)
+	ctx = WithCausationID(ctx, event.GetEventID())
+
+	if actor := event.GetActor(); actor != "" {
+		ctx = WithActor(ctx, actor)
+	}
+	if tenantID := event.GetTenantID(); tenantID != "" {
+		ctx = WithTenantID(ctx, tenantID)
+	}
+	return ctx
+}
+
+func contextString(ctx context.Context, key metadataContextKey) string {
+	value, _ := ctx.Value(key).(string)
+	return value
+}
+
+// metadataFields parse json object metadata into its raw fields.
+func metadataFields(metadataBytes []byte) (map[string]json.RawMessage, error) {
+	metadata := make(map[string]json.RawMessage)
+	if len(metadataBytes) == 0 {
+		return metadata, nil
+	}
+	if err := serializer.Unmarshal(metadataBytes, &metadata); err != nil {
+		return nil, errors.Wrap(err, "metadata is not json object")
+	}
+	if metadata == nil {
+		metadata = make(map[string]json.RawMessage)
+	}
+	return metadata, nil
+}
+
+// setStandardMetadata fill standard metadata from context, fields already set by the application are kept.
+func (e *Event) setStandardMetadata(ctx context.Context, sourceService string) error {
+	metadata, err := metadataFields(e.GetMetadata())
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]string{
+		MetadataCorrelationID: CorrelationIDFromContext(ctx),
+		MetadataCausationID:   CausationIDFromContext(ctx),
+		MetadataActor:         ActorFromContext(ctx),
+		MetadataTenantID:      TenantIDFromContext(ctx),
+		MetadataSourceService: sourceService,
+	}
+	for key, value := range fields {
+		if _, ok := metadata[key]; ok || value == "" {
+			continue
+		}
+		if metadata[key], err = serializer.Marshal(value); err != nil {
+			return errors.Wrap(err, "serializer.Marshal")
+		}
+	}
+
+	if _, ok := metadata[MetadataTraceContext]; !ok {
+		if span := opentracing.SpanFromContext(ctx); span != nil {
+			if traceContext := tracing.ExtractTextMapCarrierBytes(span.Context()); len(traceContext) > 0 && string(traceContext) != "{}" {
+				metadata[MetadataTraceContext] = json.RawMessage(traceContext)
+			}
+		}
+	}
+
+	return e.SetMetadata(metadata)
+}
+
+// GetCorrelationID correlation id of the business flow the Event belongs to.
+func (e *Event) GetCorrelationID() string {
+	return e.getMetadataString(MetadataCorrelationID)
+}
+
+// GetCausationID id of the command or event which caused the Event.
+func (e *Event) GetCausationID() string {
+	return e.getMetadataString(MetadataCausationID)
+}
+
+// GetActor user or system actor on whose behalf the Event was saved.
+func (e *Event) GetActor() string {
+	return e.getMetadataString(MetadataActor)
+}
+
+// GetTenantID tenant of the Event.
+func (e *Event) GetTenantID() string {
+	return e.getMetadataString(MetadataTenantID)
+}
+
+// GetSourceService name of the service which saved the Event.
+func (e *Event) GetSourceService() string {
+	return e.getMetadataString(MetadataSourceService)
+}
+
+// GetTraceContext opentracing text map of the span which saved the Event, nil if missing.
+func (e *Event) GetTraceContext() opentracing.TextMapCarrier {
+	var traceContext opentracing.TextMapCarrier
+	if err := e.GetMetadataField(MetadataTraceContext, &traceContext); err != nil {
+		return nil
+	}
+	return traceContext
+}
+
+// GetSpanContext extract span context of the span which saved the Event with global tracer.
+func (e *Event) GetSpanContext() (opentracing.SpanContext, error) {
+	traceContext := e.GetTraceContext()
+	if traceContext == nil {
+		return nil, opentracing.ErrSpanContextNotFound
+	}
+	return opentracing.GlobalTracer().Extract(opentracing.TextMap, traceContext)
+}
+
+func (e *Event) getMetadataString(key string) string {
+	var value string
+	if err := e.GetMetadataField(key, &value); err != nil {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,132 @@
+package es
+
+import (
+	"context"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+const (
+	defaultExecuteMaxAttempts = 3
+	defaultExecuteBackoff     = 50 * time.Millisecond
+)
+
+// ExecuteMode create-vs-update semantics of Execute.
+type ExecuteMode int
+
+const (
+	// ExecuteCreateOrUpdate run decision on new or existing aggregate.
+	ExecuteCreateOrUpdate ExecuteMode = iota
+	// ExecuteCreate run decision only if aggregate does not exist, otherwise ErrAlreadyExists.
+	ExecuteCreate
+	// ExecuteUpdate run decision only on existing aggregate, otherwise ErrAggregateNotFound.
+	ExecuteUpdate
+)
+
+type executeOptions struct {
+	mode        ExecuteMode
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// ExecuteOption optional Execute behavior.
+type ExecuteOption func(o *executeOptions)
+
+// WithExecuteMode set create-vs-update semantics.
+func WithExecuteMode(mode ExecuteMode) ExecuteOption {
+	return func(o *executeOptions) {
+		o.mode = mode
+	}
+}
+
+// WithConflictRetry retry on ErrConcurrencyConflict up to maxAttempts with exponential backoff.
+func WithConflictRetry(maxAttempts int, backoff time.Duration) ExecuteOption {
+	return func(o *executeOptions) {
+		o.maxAttempts = maxAttempts
+		o.backoff = backoff
+	}
+}
+
+// Execute load aggregate with given id, run decision on it and save uncommitted events.
+// On concurrency conflict aggregate is reloaded and decision is run again.
+// Factory must return new empty aggregate, Execute set its ID.
+// Example:
+//
+//	order, err := es.Execute(ctx, store, NewOrderAggregate, cmd.GetAggregateID(), func(a *OrderAggregate) error {
+//		return a.PayOrder(ctx, cmd.Payment)
+//	}, es.WithExecuteMode(es.ExecuteUpdate))
+func Execute[A Aggregate](ctx context.Context, store AggregateStore, factory func() A, id string, decide func(aggregate A) error, opts ...ExecuteOption) (A, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es.Execute")
+	defer span.Finish()
+	span.LogFields(log.String("aggregateID", id))
+
+	options := executeOptions{
+		mode:        ExecuteCreateOrUpdate,
+		maxAttempts: defaultExecuteMaxAttempts,
+		backoff:     defaultExecuteBackoff,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.maxAttempts <= 0 {
+		options.maxAttempts = 1
+	}
+
+	var aggregate A
+	var err error
+	backoff := options.backoff
+
+	for attempt := 1; attempt <= options.maxAttempts; attempt++ {
+		aggregate, err = executeOnce(ctx, store, factory, id, decide, options.mode)
+		if err == nil || !errors.Is(err, ErrConcurrencyConflict) || attempt == options.maxAttempts {
+			break
+		}
+
+		span.LogFields(log.Int("conflictAttempt", attempt))
+		select {
+		case <-ctx.Done():
+			return aggregate, tracing.TraceWithErr(span, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return aggregate, tracing.TraceWithErr(span, err)
+}
+
+func executeOnce[A Aggregate](ctx context.Context, store AggregateStore, factory func() A, id string, decide func(aggregate A) error, mode ExecuteMode) (A, error) {
+	aggregate := factory()
+	aggregate.SetID(id)
+
+	exists, err := store.Exists(ctx, id)
+	if err != nil {
+		return aggregate, errors.Wrap(err, "store.Exists")
+	}
+
+	switch {
+	case mode == ExecuteCreate && exists:
+		return aggregate, errors.Wrapf(ErrAlreadyExists, "aggregateID: %s", id)
+	case mode == ExecuteUpdate && !exists:
+		return aggregate, errors.Wrapf(ErrAggregateNotFound, "aggregateID: %s", id)
+	}
+
+	if exists {
+		if err := store.Load(ctx, aggregate); err != nil {
+			return aggregate, errors.Wrap(err, "store.Load")
+		}
+	}
+
+	if err := decide(aggregate); err != nil {
+		return aggregate, err
+	}
+
+	if err := store.Save(ctx, aggregate); err != nil {
+		return aggregate, errors.Wrap(err, "store.Save")
+	}
+
+	return aggregate, nil
+}
@@ -0,0 +1,47 @@
+package es
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ExpectedVersion version of the aggregate stream the writer expects before appending new events.
+type ExpectedVersion int64
+
+const (
+	// ExpectedAnyVersion append events regardless of the current stream version.
+	ExpectedAnyVersion ExpectedVersion = -2
+	// ExpectedNoStream append events only if the aggregate stream does not exist yet.
+	ExpectedNoStream ExpectedVersion = -1
+)
+
+// ExactVersion expect the aggregate stream to be exactly at the given version, 0 is the same as ExpectedNoStream.
+func ExactVersion(version uint64) ExpectedVersion {
+	return ExpectedVersion(version)
+}
+
+// Check compare ExpectedVersion with the current stream version and return ErrConcurrencyConflict on mismatch.
+func (v ExpectedVersion) Check(currentVersion uint64, exists bool) error {
+	switch {
+	case v == ExpectedAnyVersion:
+		return nil
+	case v == ExpectedNoStream && exists:
+		return errors.Wrapf(ErrConcurrencyConflict, "expected no stream, current version: %d", currentVersion)
+	case v >= 0 && uint64(v) != currentVersion:
+		return errors.Wrapf(ErrConcurrencyConflict, "expected version: %d, current version: %d", v, currentVersion)
+	}
+
+	return nil
+}
+
+func (v ExpectedVersion) String() string {
+	switch v {
+	case ExpectedAnyVersion:
+		return "any"
+	case ExpectedNoStream:
+		return "no stream"
+	default:
+		return fmt.Sprintf("%d", v)
+	}
+}
@@ -0,0 +1,57 @@
+package es
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestExpectedVersionCheck(t *testing.T) {
+	tests := []struct {
+		name           string
+		expected       ExpectedVersion
+		currentVersion uint64
+		exists         bool
+		conflict       bool
+	}{
+		{name: "any version of new stream", expected: ExpectedAnyVersion},
+		{name: "any version of existing stream", expected: ExpectedAnyVersion, currentVersion: 5, exists: true},
+		{name: "no stream of new stream", expected: ExpectedNoStream},
+		{name: "no stream of existing stream", expected: ExpectedNoStream, currentVersion: 1, exists: true, conflict: true},
+		{name: "exact version zero of new stream", expected: ExactVersion(0)},
+		{name: "exact version zero of existing stream", expected: ExactVersion(0), currentVersion: 2, exists: true, conflict: true},
+		{name: "exact version match", expected: ExactVersion(3), currentVersion: 3, exists: true},
+		{name: "exact version behind", expected: ExactVersion(2), currentVersion: 3, exists: true, conflict: true},
+		{name: "exact version ahead", expected: ExactVersion(4), currentVersion: 3, exists: true, conflict: true},
+		{name: "exact version of new stream", expected: ExactVersion(1), conflict: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.expected.Check(tt.currentVersion, tt.exists)
+			if tt.conflict != errors.Is(err, ErrConcurrencyConflict) {
+				t.Fatalf("Check(%d, %v) with %s: err = %v, want conflict %v", tt.currentVersion, tt.exists, tt.expected, err, tt.conflict)
+			}
+			if !tt.conflict && err != nil {
+				t.Fatalf("Check(%d, %v) with %s: unexpected err %v", tt.currentVersion, tt.exists, tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestExpectedVersionString(t *testing.T) {
+	tests := []struct {
+		expected ExpectedVersion
+		want     string
+	}{
+		{expected: ExpectedAnyVersion, want: "any"},
+		{expected: ExpectedNoStream, want: "no stream"},
+		{expected: ExactVersion(7), want: "7"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.expected.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package es
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+const (
+	defaultIdempotencyRetention     = 24 * time.Hour
+	defaultIdempotencyPurgeInterval = 1 * time.Hour
+)
+
+// ErrDuplicateCommand command with the same idempotency key was already applied, returned wrapped in DuplicateCommandError.
+var ErrDuplicateCommand = errors.New("Duplicate command")
+
+// IdempotencyRecord result of the Save stored under idempotency key.
+type IdempotencyRecord struct {
+	IdempotencyKey string
+	AggregateID    string
+	AggregateType  AggregateType
+	// Version of the aggregate after the original Save.
+	Version   uint64
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// DuplicateCommandError typed error of repeated idempotency key with the original result,
+// errors.Is(err, ErrDuplicateCommand) is true for it.
+type DuplicateCommandError struct {
+	Record IdempotencyRecord
+}
+
+func (e *DuplicateCommandError) Error() string {
+	return fmt.Sprintf("%s: idempotencyKey: %s, aggregateID: %s, version: %d", ErrDuplicateCommand, e.Record.IdempotencyKey, e.Record.AggregateID, e.Record.Version)
+}
+
+// Is match ErrDuplicateCommand.
+func (e *DuplicateCommandError) Is(target error) bool {
+	return target == ErrDuplicateCommand
+}
+
+// IdempotencyStore is responsible for idempotency keys stored by Save.
+type IdempotencyStore interface {
+	// GetIdempotencyRecords load not expired results stored under idempotency key, one per aggregate, empty if key is unknown.
+	GetIdempotencyRecords(ctx context.Context, idempotencyKey string) ([]IdempotencyRecord, error)
+
+	// PurgeIdempotencyKeys delete keys older than retention and return count of deleted keys,
+	// run it periodically with IdempotencyKeyPurger.
+	PurgeIdempotencyKeys(ctx context.Context) (int64, error)
+}
+
+// IdempotentCommand command carrying idempotency key, empty key disables deduplication.
+type IdempotentCommand interface {
+	Command
+	GetIdempotencyKey() string
+}
+
+type idempotencyContextKey struct{}
+
+// WithIdempotencyKey return context with idempotency key stored atomically with events by Save,
+// Save of the same aggregate with already stored key returns DuplicateCommandError instead of saving events.
+func WithIdempotencyKey(ctx context.Context, idempotencyKey string) context.Context {
+	return context.WithValue(ctx, idempotencyContextKey{}, idempotencyKey)
+}
+
+// IdempotencyKeyFromContext idempotency key set by WithIdempotencyKey.
+func IdempotencyKeyFromContext(ctx context.Context) string {
+	idempotencyKey, _ := ctx.Value(idempotencyContextKey{}).(string)
+	return idempotencyKey
+}
+
+// IdempotencyMiddleware put idempotency key of IdempotentCommand into context for Save,
+// command with key already stored for its aggregate is not handled and returns DuplicateCommandError.
+// Keys are scoped per aggregate like in Save, the same key of another aggregate is not a duplicate.
+func IdempotencyMiddleware(store IdempotencyStore) CommandMiddleware {
+	return func(next CommandHandlerFunc) CommandHandlerFunc {
+		return func(ctx context.Context, command Command) error {
+			idempotencyKey := IdempotencyKeyFromContext(ctx)
+			if idempotentCommand, ok := command.(IdempotentCommand); ok && idempotentCommand.GetIdempotencyKey() != "" {
+				idempotencyKey = idempotentCommand.GetIdempotencyKey()
+			}
+			if idempotencyKey == "" {
+				return next(ctx, command)
+			}
+
+			records, err := store.GetIdempotencyRecords(ctx, idempotencyKey)
+			if err != nil {
+				return errors.Wrap(err, "store.GetIdempotencyRecords")
+			}
+			for _, record := range records {
+				if record.AggregateID == command.GetAggregateID() {
+					return &DuplicateCommandError{Record: record}
+				}
+			}
+
+			return next(WithIdempotencyKey(ctx, idempotencyKey), command)
+		}
+	}
+}
+
+// saveIdempotencyKeyTx store idempotency key of the saved aggregate, returns DuplicateCommandError if key was stored before.
+// Concurrent saves with the same key wait for each other on the primary key, so only one of them commits events.
+func (p *pgEventStore) saveIdempotencyKeyTx(ctx context.Context, tx pgx.Tx, idempotencyKey string, aggregate Aggregate) error {
+	result, err := tx.Exec(ctx, saveIdempotencyKeyQuery, idempotencyKey, aggregate.GetID(), aggregate.GetType(), aggregate.GetVersion(), p.cfg.idempotencyRetention().Milliseconds())
+	if err != nil {
+		p.log.Errorf("(saveIdempotencyKeyTx) tx.Exec err: %v", err)
+		return errors.Wrap(err, "tx.Exec")
+	}
+	if result.RowsAffected() > 0 {
+		return nil
+	}
+
+	var record IdempotencyRecord
+	if err := tx.QueryRow(ctx, getIdempotencyKeyQuery, idempotencyKey, aggregate.GetID()).Scan(
+		&record.IdempotencyKey,
+		&record.AggregateID,
+		&record.AggregateType,
+		&record.Version,
+		&record.CreatedAt,
+		&record.ExpiresAt,
+	); err != nil {
+		p.log.Errorf("(saveIdempotencyKeyTx) tx.QueryRow err: %v", err)
+		return errors.Wrap(err, "tx.QueryRow")
+	}
+
+	return &DuplicateCommandError{Record: record}
+}
+
+// GetIdempotencyRecords load idempotency key results from microservices.idempotency_keys
+func (p *pgEventStore) GetIdempotencyRecords(ctx context.Context, idempotencyKey string) ([]IdempotencyRecord, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.GetIdempotencyRecords")
+	defer span.Finish()
+	span.LogFields(log.String("idempotencyKey", idempotencyKey))
+
+	rows, err := p.db.Query(ctx, getIdempotencyRecordsQuery, idempotencyKey)
+	if err != nil {
+		p.log.Errorf("(GetIdempotencyRecords) db.Query err: %v", err)
+		return nil, tracing.TraceWithErr(span, errors.Wrap(err, "db.Query"))
+	}
+	defer rows.Close()
+
+	records := make([]IdempotencyRecord, 0)
+	for rows.Next() {
+		var record IdempotencyRecord
+		if err := rows.Scan(
+			&record.IdempotencyKey,
+			&record.AggregateID,
+			&record.AggregateType,
+			&record.Version,
+			&record.CreatedAt,
+			&record.ExpiresAt,
+		); err != nil {
+			p.log.Errorf("(GetIdempotencyRecords) rows.Scan err: %v", err)
+			return nil, tracing.TraceWithErr(span, errors.Wrap(err, "rows.Scan"))
+		}
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		p.log.Errorf("(GetIdempotencyRecords) rows.Err err: %v", err)
+		return nil, tracing.TraceWithErr(span, errors.Wrap(err, "rows.Err"))
+	}
+
+	return records, nil
+}
+
+// PurgeIdempotencyKeys delete expired idempotency keys
+func (p *pgEventStore) PurgeIdempotencyKeys(ctx context.Context) (int64, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.PurgeIdempotencyKeys")
+	defer span.Finish()
+
+	result, err := p.db.Exec(ctx, purgeIdempotencyKeysQuery)
+	if err != nil {
+		p.log.Errorf("(PurgeIdempotencyKeys) db.Exec err: %v", err)
+		return 0, tracing.TraceWithErr(span, errors.Wrap(err, "db.Exec"))
+	}
+
+	p.log.Infof("(PurgeIdempotencyKeys) deleted: %d", result.RowsAffected())
+	return result.RowsAffected(), nil
+}
+
+// IdempotencyKeyPurger delete expired idempotency keys with given interval, expired keys are kept until purged.
+type IdempotencyKeyPurger struct {
+	log      logger.Logger
+	store    IdempotencyStore
+	interval time.Duration
+}
+
+// NewIdempotencyKeyPurger IdempotencyKeyPurger constructor, interval is 1h if zero.
+func NewIdempotencyKeyPurger(log logger.Logger, store IdempotencyStore, interval time.Duration) *IdempotencyKeyPurger {
+	if interval <= 0 {
+		interval = defaultIdempotencyPurgeInterval
+	}
+	return &IdempotencyKeyPurger{log: log, store: store, interval: interval}
+}
+
+// Run purge expired keys on start and then every interval until context is done.
+func (p *IdempotencyKeyPurger) Run(ctx context.Context) error {
+	p.log.Infof("(Starting IdempotencyKeyPurger) interval: %s", p.interval)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := p.store.PurgeIdempotencyKeys(ctx); err != nil {
+			p.log.Errorf("(IdempotencyKeyPurger) PurgeIdempotencyKeys err: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			p.log.Infof("(IdempotencyKeyPurger) stopped: %v", ctx.Err())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -3,6 +3,7 @@ package es
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/opentracing/opentracing-go"
@@ -13,6 +14,17 @@ import (
 	"github.com/segmentio/kafka-go"
 )
 
+const (
+	// ContentTypeHeader kafka message header with content type of the events data codec.
+	ContentTypeHeader = "es-content-type"
+	// EventTypeHeader kafka message header with EventType of the single event message.
+	EventTypeHeader = "es-event-type"
+	// VersionHeader kafka message header with aggregate Version of the single event message.
+	VersionHeader = "es-version"
+	// AggregateTypeHeader kafka message header with AggregateType of the single event message.
+	AggregateTypeHeader = "es-aggregate-type"
+)
+
 // KafkaEventBusConfig kafka eventbus config
 type KafkaEventBusConfig struct {
 	Topic             string `mapstructure:"topic" validae:"required"`
@@ -20,6 +32,19 @@ type KafkaEventBusConfig struct {
 	Partitions        int    `mapstructure:"partitions" validate:"required,gte=0"`
 	ReplicationFactor int    `mapstructure:"replicationFactor" validate:"required,gte=0"`
 	Headers           []kafka.Header
+	// CloudEventsMode publish every event as CloudEvents 1.0 message in structured or binary mode, empty publish []Event json.
+	CloudEventsMode CloudEventsMode `mapstructure:"cloudEventsMode"`
+	// MessagePerEvent publish every event as own []Event message keyed by AggregateID,
+	// NewKafkaEventsBus rejects producer without key hash balancer (kafka.NewHashProducer) to keep per-aggregate ordering.
+	MessagePerEvent bool `mapstructure:"messagePerEvent"`
+}
+
+// ErrKafkaProducerNotHashing producer of MessagePerEvent mode does not partition messages by key.
+var ErrKafkaProducerNotHashing = errors.New("Kafka producer does not partition messages by key")
+
+// balancerProducer producer exposing its writer balancer, implemented by kafka package producers.
+type balancerProducer interface {
+	Balancer() kafka.Balancer
 }
 
 type KafkaEventsBus struct {
@@ -27,11 +52,27 @@ type KafkaEventsBus struct {
 	cfg      KafkaEventBusConfig
 }
 
-// NewKafkaEventsBus kafkaEventsBus constructor.
-func NewKafkaEventsBus(producer kafkaClient.Producer, cfg KafkaEventBusConfig) *KafkaEventsBus {
+// NewKafkaEventsBus kafkaEventsBus constructor, in MessagePerEvent mode producer balancer must hash message keys.
+func NewKafkaEventsBus(producer kafkaClient.Producer, cfg KafkaEventBusConfig) (*KafkaEventsBus, error) {
+	if cfg.MessagePerEvent && cfg.CloudEventsMode == CloudEventsModeNone {
+		if bp, ok := producer.(balancerProducer); ok && !isKeyHashBalancer(bp.Balancer()) {
+			return nil, errors.Wrapf(ErrKafkaProducerNotHashing, "balancer: %T", bp.Balancer())
+		}
+	}
+
 	return &KafkaEventsBus{
 		producer: producer,
 		cfg:      cfg,
+	}, nil
+}
+
+// isKeyHashBalancer balancer sends messages with the same key to the same partition.
+func isKeyHashBalancer(balancer kafka.Balancer) bool {
+	switch balancer.(type) {
+	case *kafka.Hash, *kafka.ReferenceHash, kafka.CRC32Balancer, *kafka.CRC32Balancer, kafka.Murmur2Balancer, *kafka.Murmur2Balancer:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -40,19 +81,92 @@ func (e *KafkaEventsBus) ProcessEvents(ctx context.Context, events []Event) erro
 	span, ctx := opentracing.StartSpanFromContext(ctx, "KafkaEventsBus.ProcessEvents")
 	defer span.Finish()
 
+	if e.cfg.CloudEventsMode != CloudEventsModeNone {
+		return tracing.TraceWithErr(span, e.processCloudEvents(ctx, span, events))
+	}
+
+	if e.cfg.MessagePerEvent {
+		return tracing.TraceWithErr(span, e.processEventMessages(ctx, span, events))
+	}
+
 	eventsBytes, err := serializer.Marshal(events)
 	if err != nil {
 		return tracing.TraceWithErr(span, errors.Wrap(err, "serializer.Marshal"))
 	}
 
+	// events of one save are serialized with the same codec, every event keeps own content type in metadata
+	headers := append(tracing.GetKafkaTracingHeadersFromSpanCtx(span.Context()), kafka.Header{
+		Key:   ContentTypeHeader,
+		Value: []byte(events[0].GetContentType()),
+	})
+
 	return e.producer.PublicMessage(ctx, kafka.Message{
 		Topic:   GetTopicName(e.cfg.TopicPerfix, string(events[0].GetAggregateType())),
 		Value:   eventsBytes,
-		Headers: tracing.GetKafkaTracingHeadersFromSpanCtx(span.Context()),
+		Headers: headers,
 		Time:    time.Now().UTC(),
 	})
 }
 
+// processCloudEvents publish each event as CloudEvents kafka message.
+func (e *KafkaEventsBus) processCloudEvents(ctx context.Context, span opentracing.Span, events []Event) error {
+	tracingHeaders := tracing.GetKafkaTracingHeadersFromSpanCtx(span.Context())
+	messages := make([]kafka.Message, 0, len(events))
+
+	for _, event := range events {
+		message, err := EncodeCloudEvent(event, e.cfg.CloudEventsMode)
+		if err != nil {
+			return errors.Wrap(err, "EncodeCloudEvent")
+		}
+
+		message.Topic = GetTopicName(e.cfg.TopicPerfix, string(event.GetAggregateType()))
+		message.Key = []byte(event.GetAggregateID())
+		message.Headers = append(message.Headers, tracingHeaders...)
+		message.Headers = append(message.Headers, getEventHeaders(event)...)
+		message.Time = time.Now().UTC()
+		messages = append(messages, message)
+	}
+
+	return e.producer.PublicMessage(ctx, messages...)
+}
+
+// processEventMessages publish each event as own message keyed by AggregateID with event headers.
+func (e *KafkaEventsBus) processEventMessages(ctx context.Context, span opentracing.Span, events []Event) error {
+	tracingHeaders := tracing.GetKafkaTracingHeadersFromSpanCtx(span.Context())
+	messages := make([]kafka.Message, 0, len(events))
+
+	for _, event := range events {
+		eventBytes, err := serializer.Marshal([]Event{event})
+		if err != nil {
+			return errors.Wrap(err, "serializer.Marshal")
+		}
+
+		headers := make([]kafka.Header, 0, len(tracingHeaders)+4)
+		headers = append(headers, tracingHeaders...)
+		headers = append(headers, getEventHeaders(event)...)
+		headers = append(headers, kafka.Header{Key: ContentTypeHeader, Value: []byte(event.GetContentType())})
+
+		messages = append(messages, kafka.Message{
+			Topic:   GetTopicName(e.cfg.TopicPerfix, string(event.GetAggregateType())),
+			Key:     []byte(event.GetAggregateID()),
+			Value:   eventBytes,
+			Headers: headers,
+			Time:    time.Now().UTC(),
+		})
+	}
+
+	return e.producer.PublicMessage(ctx, messages...)
+}
+
+// getEventHeaders kafka headers of the single event message, consumers can filter events without decoding value.
+func getEventHeaders(event Event) []kafka.Header {
+	return []kafka.Header{
+		{Key: EventTypeHeader, Value: []byte(event.GetEventType())},
+		{Key: VersionHeader, Value: []byte(strconv.FormatUint(event.GetVersion(), 10))},
+		{Key: AggregateTypeHeader, Value: []byte(event.GetAggregateType())},
+	}
+}
+
 func GetTopicName(eventStorePerfix, aggregateType string) string {
 	return fmt.Sprintf("%s_%s", eventStorePerfix, aggregateType)
 }
@@ -0,0 +1,54 @@
+package es
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+type testBalancerProducer struct {
+	balancer kafka.Balancer
+}
+
+func (p *testBalancerProducer) PublicMessage(ctx context.Context, msgs ...kafka.Message) error {
+	return nil
+}
+
+func (p *testBalancerProducer) Close() error {
+	return nil
+}
+
+func (p *testBalancerProducer) Balancer() kafka.Balancer {
+	return p.balancer
+}
+
+func TestNewKafkaEventsBusBalancer(t *testing.T) {
+	tests := []struct {
+		name     string
+		balancer kafka.Balancer
+		cfg      KafkaEventBusConfig
+		wantErr  bool
+	}{
+		{name: "hash", balancer: &kafka.Hash{}, cfg: KafkaEventBusConfig{MessagePerEvent: true}},
+		{name: "reference hash", balancer: &kafka.ReferenceHash{}, cfg: KafkaEventBusConfig{MessagePerEvent: true}},
+		{name: "crc32", balancer: kafka.CRC32Balancer{}, cfg: KafkaEventBusConfig{MessagePerEvent: true}},
+		{name: "murmur2", balancer: &kafka.Murmur2Balancer{}, cfg: KafkaEventBusConfig{MessagePerEvent: true}},
+		{name: "least bytes", balancer: &kafka.LeastBytes{}, cfg: KafkaEventBusConfig{MessagePerEvent: true}, wantErr: true},
+		{name: "default round robin", balancer: nil, cfg: KafkaEventBusConfig{MessagePerEvent: true}, wantErr: true},
+		{name: "least bytes of batch messages", balancer: &kafka.LeastBytes{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKafkaEventsBus(&testBalancerProducer{balancer: tt.balancer}, tt.cfg)
+			if tt.wantErr != errors.Is(err, ErrKafkaProducerNotHashing) {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
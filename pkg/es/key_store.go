@@ -0,0 +1,110 @@
+package es
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+type pgKeyProvider struct {
+	log       logger.Logger
+	db        *pgxpool.Pool
+	masterKey []byte
+}
+
+// NewPgKeyProvider postgres KeyProvider constructor, data keys are stored in microservices.encryption_keys
+// encrypted with AES master key of 16, 24 or 32 bytes which must be kept outside of the database.
+func NewPgKeyProvider(log logger.Logger, db *pgxpool.Pool, masterKey []byte) *pgKeyProvider {
+	return &pgKeyProvider{log: log, db: db, masterKey: masterKey}
+}
+
+// GetOrCreateKey load subject data key or create new one, deleted keys are never recreated.
+func (k *pgKeyProvider) GetOrCreateKey(ctx context.Context, subjectID string) ([]byte, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgKeyProvider.GetOrCreateKey")
+	defer span.Finish()
+	span.LogFields(log.String("subjectID", subjectID))
+
+	dataKey, found, err := k.getKey(ctx, subjectID)
+	if err != nil || found {
+		return dataKey, tracing.TraceWithErr(span, err)
+	}
+
+	if dataKey, err = newDataKey(); err != nil {
+		return nil, tracing.TraceWithErr(span, err)
+	}
+
+	encryptedKey, err := seal(k.masterKey, dataKey, subjectID)
+	if err != nil {
+		return nil, tracing.TraceWithErr(span, errors.Wrap(err, "seal"))
+	}
+
+	// concurrent writers of a new subject keep the first created key
+	if _, err := k.db.Exec(ctx, createKeyQuery, subjectID, encryptedKey); err != nil {
+		k.log.Errorf("(GetOrCreateKey) db.Exec err: %v", err)
+		return nil, tracing.TraceWithErr(span, errors.Wrap(err, "db.Exec"))
+	}
+
+	dataKey, _, err = k.getKey(ctx, subjectID)
+	return dataKey, tracing.TraceWithErr(span, err)
+}
+
+// GetKey load and decrypt subject data key.
+func (k *pgKeyProvider) GetKey(ctx context.Context, subjectID string) ([]byte, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgKeyProvider.GetKey")
+	defer span.Finish()
+	span.LogFields(log.String("subjectID", subjectID))
+
+	dataKey, found, err := k.getKey(ctx, subjectID)
+	if err != nil {
+		return nil, tracing.TraceWithErr(span, err)
+	}
+	if !found {
+		return nil, errors.Wrapf(ErrSubjectForgotten, "subjectID: %s", subjectID)
+	}
+
+	return dataKey, nil
+}
+
+// getKey load subject data key, found is false if subject has no key row, deleted key returns ErrSubjectForgotten.
+func (k *pgKeyProvider) getKey(ctx context.Context, subjectID string) ([]byte, bool, error) {
+	var encryptedKey []byte
+	if err := k.db.QueryRow(ctx, getKeyQuery, subjectID).Scan(&encryptedKey); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, false, nil
+		}
+		k.log.Errorf("(getKey) db.QueryRow err: %v", err)
+		return nil, false, errors.Wrap(err, "db.QueryRow")
+	}
+
+	if encryptedKey == nil {
+		return nil, true, errors.Wrapf(ErrSubjectForgotten, "subjectID: %s", subjectID)
+	}
+
+	dataKey, err := open(k.masterKey, encryptedKey, subjectID)
+	if err != nil {
+		return nil, true, errors.Wrap(err, "open")
+	}
+
+	return dataKey, true, nil
+}
+
+// DeleteKey erase subject data key and keep tombstone, so the key is never recreated for the subject.
+func (k *pgKeyProvider) DeleteKey(ctx context.Context, subjectID string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgKeyProvider.DeleteKey")
+	defer span.Finish()
+	span.LogFields(log.String("subjectID", subjectID))
+
+	if _, err := k.db.Exec(ctx, deleteKeyQuery, subjectID); err != nil {
+		k.log.Errorf("(DeleteKey) db.Exec err: %v", err)
+		return tracing.TraceWithErr(span, errors.Wrap(err, "db.Exec"))
+	}
+
+	k.log.Infof("(DeleteKey) subjectID: %s forgotten", subjectID)
+	return nil
+}
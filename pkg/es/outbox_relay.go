@@ -0,0 +1,297 @@
+package es
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+const (
+	defaultOutboxBatchSize      = 100
+	defaultOutboxPollInterval   = 1 * time.Second
+	defaultOutboxInitialBackoff = 1 * time.Second
+	defaultOutboxMaxBackoff     = 5 * time.Minute
+	defaultOutboxRetention      = 7 * 24 * time.Hour
+
+	// purgesPerRetention how many times per Retention period sent records are purged
+	purgesPerRetention = 24
+)
+
+// OutboxRelayConfig outbox relay config
+type OutboxRelayConfig struct {
+	BatchSize      int           `mapstructure:"batchSize" validate:"gte=0"`
+	PollInterval   time.Duration `mapstructure:"pollInterval"`
+	InitialBackoff time.Duration `mapstructure:"initialBackoff"`
+	MaxBackoff     time.Duration `mapstructure:"maxBackoff"`
+	// Retention how long sent records are kept before Run purges them.
+	Retention time.Duration `mapstructure:"retention"`
+}
+
+type outboxRecord struct {
+	ID            int64
+	Event         Event
+	Attempts      int
+	NextAttemptAt time.Time
+}
+
+// OutboxRelay publish events saved to microservices.outbox with EventBus, at-least-once and in order per aggregate.
+type OutboxRelay struct {
+	log      logger.Logger
+	cfg      OutboxRelayConfig
+	db       *pgxpool.Pool
+	eventBus EventBus
+	shredder *CryptoShredder
+}
+
+// OutboxRelayOption optional OutboxRelay dependency.
+type OutboxRelayOption func(r *OutboxRelay)
+
+// WithOutboxCryptoShredder decrypt outbox records encrypted by event store with the same CryptoShredder,
+// events of forgotten subjects are published marked as forgotten.
+func WithOutboxCryptoShredder(shredder *CryptoShredder) OutboxRelayOption {
+	return func(r *OutboxRelay) {
+		r.shredder = shredder
+	}
+}
+
+// NewOutboxRelay OutboxRelay constructor.
+func NewOutboxRelay(log logger.Logger, cfg OutboxRelayConfig, db *pgxpool.Pool, eventBus EventBus, opts ...OutboxRelayOption) *OutboxRelay {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultOutboxBatchSize
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultOutboxPollInterval
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = defaultOutboxInitialBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultOutboxMaxBackoff
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = defaultOutboxRetention
+	}
+
+	r := &OutboxRelay{
+		log:      log,
+		cfg:      cfg,
+		db:       db,
+		eventBus: eventBus,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// Run poll outbox with configured interval until context is done, sent records older than Retention are purged when outbox is drained.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	r.log.Infof("(Starting OutboxRelay) batchSize: %d, pollInterval: %s, retention: %s", r.cfg.BatchSize, r.cfg.PollInterval, r.cfg.Retention)
+
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+
+	var lastPurge time.Time
+	for {
+		published, err := r.RelayPending(ctx)
+		if err != nil {
+			r.log.Errorf("(OutboxRelay) RelayPending err: %v", err)
+		}
+
+		// outbox has more pending events, don't wait for next tick
+		if err == nil && published == r.cfg.BatchSize {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		if time.Since(lastPurge) >= r.cfg.Retention/purgesPerRetention {
+			if _, err := r.PurgeSent(ctx); err != nil {
+				r.log.Errorf("(OutboxRelay) PurgeSent err: %v", err)
+			}
+			lastPurge = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			r.log.Infof("(OutboxRelay) stopped: %v", ctx.Err())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeSent delete sent records older than Retention and return count of deleted records.
+func (r *OutboxRelay) PurgeSent(ctx context.Context) (int64, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "OutboxRelay.PurgeSent")
+	defer span.Finish()
+
+	result, err := r.db.Exec(ctx, purgeSentOutboxQuery, r.cfg.Retention.Milliseconds())
+	if err != nil {
+		return 0, tracing.TraceWithErr(span, errors.Wrap(err, "db.Exec"))
+	}
+
+	r.log.Debugf("(PurgeSent) deleted: %d", result.RowsAffected())
+	return result.RowsAffected(), nil
+}
+
+// RelayPending publish one batch of pending outbox events and return count of published events.
+// Only one relay instance process outbox at a time, others skip the batch while advisory lock is held.
+func (r *OutboxRelay) RelayPending(ctx context.Context) (int, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "OutboxRelay.RelayPending")
+	defer span.Finish()
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, tracing.TraceWithErr(span, errors.Wrap(err, "db.Begin"))
+	}
+	defer func() {
+		if txErr := tx.Rollback(ctx); txErr != nil && !errors.Is(txErr, pgx.ErrTxClosed) {
+			r.log.Errorf("(RelayPending) tx.Rollback err: %v", txErr)
+		}
+	}()
+
+	var locked bool
+	if err := tx.QueryRow(ctx, lockOutboxRelayQuery).Scan(&locked); err != nil {
+		return 0, tracing.TraceWithErr(span, errors.Wrap(err, "tx.QueryRow"))
+	}
+	if !locked {
+		span.LogFields(log.Bool("locked", locked))
+		return 0, nil
+	}
+
+	records, err := r.getPendingTx(ctx, tx)
+	if err != nil {
+		return 0, tracing.TraceWithErr(span, err)
+	}
+
+	published := 0
+	// records of aggregates waiting for backoff are not selected, so order per aggregate is kept
+	for _, aggregateRecords := range groupOutboxByAggregate(records) {
+		events := make([]Event, 0, len(aggregateRecords))
+		ids := make([]int64, 0, len(aggregateRecords))
+		for _, record := range aggregateRecords {
+			events = append(events, record.Event)
+			ids = append(ids, record.ID)
+		}
+
+		if err := r.publish(ctx, events); err != nil {
+			r.log.Warnf("(RelayPending) publish aggregateID: %s, err: %v", events[0].GetAggregateID(), err)
+			nextAttemptAt := time.Now().UTC().Add(r.backoff(aggregateRecords[0].Attempts))
+			if _, err := tx.Exec(ctx, markOutboxFailedQuery, ids, nextAttemptAt, err.Error()); err != nil {
+				return published, tracing.TraceWithErr(span, errors.Wrap(err, "tx.Exec"))
+			}
+			continue
+		}
+
+		if _, err := tx.Exec(ctx, markOutboxSentQuery, ids); err != nil {
+			return published, tracing.TraceWithErr(span, errors.Wrap(err, "tx.Exec"))
+		}
+		published += len(ids)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return published, tracing.TraceWithErr(span, errors.Wrap(err, "tx.Commit"))
+	}
+
+	span.LogFields(log.Int("pending", len(records)), log.Int("published", published))
+	r.log.Debugf("(RelayPending) pending: %d, published: %d", len(records), published)
+	return published, nil
+}
+
+// publish decrypt events of one aggregate and process them with EventBus.
+func (r *OutboxRelay) publish(ctx context.Context, events []Event) error {
+	for i := range events {
+		if r.shredder == nil {
+			if events[i].isEncrypted() {
+				return errors.Wrapf(ErrCryptoShredderNotConfigured, "eventID: %s", events[i].GetEventID())
+			}
+			continue
+		}
+		if err := r.shredder.Decrypt(ctx, &events[i]); err != nil {
+			return errors.Wrapf(err, "shredder.Decrypt eventID: %s", events[i].GetEventID())
+		}
+	}
+
+	if err := r.eventBus.ProcessEvents(ctx, events); err != nil {
+		return errors.Wrap(err, "eventBus.ProcessEvents")
+	}
+	return nil
+}
+
+func (r *OutboxRelay) getPendingTx(ctx context.Context, tx pgx.Tx) ([]outboxRecord, error) {
+	rows, err := tx.Query(ctx, getPendingOutboxQuery, r.cfg.BatchSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "tx.Query")
+	}
+	defer rows.Close()
+
+	records := make([]outboxRecord, 0, r.cfg.BatchSize)
+	for rows.Next() {
+		var record outboxRecord
+		if err := rows.Scan(
+			&record.ID,
+			&record.Event.EventID,
+			&record.Event.AggregateID,
+			&record.Event.AggregateType,
+			&record.Event.EventType,
+			&record.Event.Data,
+			&record.Event.Version,
+			&record.Event.Metadata,
+			&record.Event.Timestamp,
+			&record.Event.SchemaVersion,
+			&record.Attempts,
+			&record.NextAttemptAt,
+		); err != nil {
+			return nil, errors.Wrap(err, "rows.Scan")
+		}
+
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "rows.Err")
+	}
+
+	return records, nil
+}
+
+// backoff exponential backoff for given count of failed attempts limited with MaxBackoff.
+func (r *OutboxRelay) backoff(attempts int) time.Duration {
+	backoff := r.cfg.InitialBackoff
+	for i := 0; i < attempts && backoff < r.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > r.cfg.MaxBackoff {
+		return r.cfg.MaxBackoff
+	}
+	return backoff
+}
+
+// groupOutboxByAggregate group records by aggregate keeping outbox order inside and between groups.
+func groupOutboxByAggregate(records []outboxRecord) [][]outboxRecord {
+	groups := make([][]outboxRecord, 0, len(records))
+	indexes := make(map[string]int, len(records))
+
+	for _, record := range records {
+		idx, ok := indexes[record.Event.GetAggregateID()]
+		if !ok {
+			idx = len(groups)
+			indexes[record.Event.GetAggregateID()] = idx
+			groups = append(groups, make([]outboxRecord, 0, 1))
+		}
+		groups[idx] = append(groups[idx], record)
+	}
+
+	return groups
+}
@@ -0,0 +1,65 @@
+package es
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGroupOutboxByAggregate(t *testing.T) {
+	record := func(id int64, aggregateID string) outboxRecord {
+		return outboxRecord{ID: id, Event: Event{AggregateID: aggregateID}}
+	}
+
+	tests := []struct {
+		name    string
+		records []outboxRecord
+		want    [][]int64
+	}{
+		{name: "empty", records: nil, want: [][]int64{}},
+		{name: "single aggregate", records: []outboxRecord{record(1, "a"), record(2, "a")}, want: [][]int64{{1, 2}}},
+		{
+			name:    "interleaved aggregates keep order",
+			records: []outboxRecord{record(1, "a"), record(2, "b"), record(3, "a"), record(4, "c"), record(5, "b")},
+			want:    [][]int64{{1, 3}, {2, 5}, {4}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups := groupOutboxByAggregate(tt.records)
+			got := make([][]int64, 0, len(groups))
+			for _, group := range groups {
+				ids := make([]int64, 0, len(group))
+				for _, record := range group {
+					ids = append(ids, record.ID)
+				}
+				got = append(got, ids)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("groupOutboxByAggregate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboxRelayBackoff(t *testing.T) {
+	r := NewOutboxRelay(nil, OutboxRelayConfig{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}, nil, nil)
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 0, want: time.Second},
+		{attempts: 1, want: 2 * time.Second},
+		{attempts: 3, want: 8 * time.Second},
+		{attempts: 4, want: 10 * time.Second},
+		{attempts: 100, want: 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := r.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -2,19 +2,31 @@ package es
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/constants"
 	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
 	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+	uuid "github.com/satori/go.uuid"
 )
 
 const (
 	eventsCapacity = 10
+
+	readAllSettleTimeout      = 5 * time.Second
+	readAllSettlePollInterval = 10 * time.Millisecond
+
+	deferredSnapshotTimeout = 10 * time.Second
+
+	uniqueViolationCode = "23505"
 )
 
 type pgEventStore struct {
@@ -23,23 +35,110 @@ type pgEventStore struct {
 	db         *pgxpool.Pool
 	eventBus   EventBus
 	serializer Serializer
+	upcasters  *UpcasterRegistry
+
+	snapshotUpcasters *SnapshotUpcasterRegistry
+	shredder          *CryptoShredder
+	archive           ArchiveStore
+
+	deferredMu        sync.RWMutex
+	deferredClosed    bool
+	deferredSnapshots chan *Snapshot
+	deferredDone      chan struct{}
+}
+
+// PgEventStoreOption optional pgEventStore dependency.
+type PgEventStoreOption func(p *pgEventStore)
+
+// WithUpcasterRegistry upcast loaded events with given registry and stamp saved events with current schema version.
+func WithUpcasterRegistry(upcasters *UpcasterRegistry) PgEventStoreOption {
+	return func(p *pgEventStore) {
+		if upcasters != nil {
+			p.upcasters = upcasters
+		}
+	}
+}
+
+// WithSnapshotUpcasterRegistry upcast loaded snapshots of old schema versions instead of ignoring them.
+func WithSnapshotUpcasterRegistry(snapshotUpcasters *SnapshotUpcasterRegistry) PgEventStoreOption {
+	return func(p *pgEventStore) {
+		if snapshotUpcasters != nil {
+			p.snapshotUpcasters = snapshotUpcasters
+		}
+	}
+}
+
+// WithCryptoShredder encrypt saved event data with per-subject keys and decrypt loaded events.
+func WithCryptoShredder(shredder *CryptoShredder) PgEventStoreOption {
+	return func(p *pgEventStore) {
+		p.shredder = shredder
+	}
+}
+
+// WithArchiveStore archive stream events to given cold storage and rehydrate them on Load.
+func WithArchiveStore(archive ArchiveStore) PgEventStoreOption {
+	return func(p *pgEventStore) {
+		p.archive = archive
+	}
 }
 
-func NewPgEventStore(log logger.Logger, cfg Config, db *pgxpool.Pool, eventBus EventBus, serializer Serializer) *pgEventStore {
-	return &pgEventStore{
+func NewPgEventStore(log logger.Logger, cfg Config, db *pgxpool.Pool, eventBus EventBus, serializer Serializer, opts ...PgEventStoreOption) *pgEventStore {
+	p := &pgEventStore{
 		log:        log,
 		cfg:        cfg,
 		db:         db,
 		eventBus:   eventBus,
 		serializer: serializer,
+		upcasters:  NewUpcasterRegistry(),
+
+		snapshotUpcasters: NewSnapshotUpcasterRegistry(),
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if cfg.SnapshotMode == SnapshotDeferred {
+		p.deferredSnapshots = make(chan *Snapshot, cfg.DeferredSnapshots.queueSize())
+		p.deferredDone = make(chan struct{})
+		go p.writeDeferredSnapshots()
+	}
+
+	return p
+}
+
+// Close stop the deferred snapshot writer after queued snapshots are written, or return ctx error if ctx is done first,
+// snapshots deferred after Close are written by the Save caller.
+func (p *pgEventStore) Close(ctx context.Context) error {
+	if p.deferredSnapshots == nil {
+		return nil
+	}
+
+	p.deferredMu.Lock()
+	if !p.deferredClosed {
+		p.deferredClosed = true
+		close(p.deferredSnapshots)
+	}
+	p.deferredMu.Unlock()
+
+	select {
+	case <-p.deferredDone:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "deferred snapshots left: %d", len(p.deferredSnapshots))
 	}
 }
 
-// handleConcurrency handle concurrency
+// handleConcurrency serialize writers of the stream, advisory lock covers the first write of new stream having no row to lock yet
 func (p *pgEventStore) handleConcurrency(ctx context.Context, tx pgx.Tx, events []Event) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.handleConcurrency")
 	defer span.Finish()
 
+	if _, err := tx.Exec(ctx, lockStreamWriterQuery, events[0].GetAggregateID()); err != nil {
+		p.log.Errorf("(handleConcurrency) tx.Exec err: %v", err)
+		return errors.Wrap(err, "tx.Exec")
+	}
+
 	result, err := tx.Exec(ctx, handleConcurrentWriteQuery, events[0].GetAggregateID())
 	if err != nil {
 		p.log.Errorf("(handleConcurrency) tx.Exec err: %v", err)
@@ -50,6 +149,28 @@ func (p *pgEventStore) handleConcurrency(ctx context.Context, tx pgx.Tx, events
 	return nil
 }
 
+// getStreamVersionTx get current version of the aggregate stream and whether the stream exists
+func (p *pgEventStore) getStreamVersionTx(ctx context.Context, tx pgx.Tx, aggregateID string) (uint64, bool, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.getStreamVersionTx")
+	defer span.Finish()
+
+	var version uint64
+	var exists bool
+	if err := tx.QueryRow(ctx, getStreamVersionQuery, aggregateID).Scan(&version, &exists); err != nil {
+		p.log.Errorf("(getStreamVersionTx) tx.QueryRow err: %v", err)
+		return 0, false, tracing.TraceWithErr(span, errors.Wrap(err, "tx.QueryRow"))
+	}
+
+	span.LogFields(log.Uint64("version", version), log.Bool("exists", exists))
+	return version, exists, nil
+}
+
+// isUniqueViolation check if postgres rejected the write because of unique (aggregate_id, version) constraint
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode
+}
+
 // RollBackTx rollback transaction
 func RollBackTx(ctx context.Context, tx pgx.Tx, err error) error {
 	if err := tx.Rollback(ctx); err != nil {
@@ -66,6 +187,54 @@ func (p *pgEventStore) processEvents(ctx context.Context, events []Event) error
 	return p.eventBus.ProcessEvents(ctx, events)
 }
 
+// processEventsTx write events to the outbox in the save transaction if enabled, otherwise publish them with event bus
+func (p *pgEventStore) processEventsTx(ctx context.Context, tx pgx.Tx, events []Event) error {
+	if !p.cfg.UseOutbox {
+		return p.processEvents(ctx, events)
+	}
+
+	return p.saveOutboxTx(ctx, tx, events)
+}
+
+// saveOutboxTx save events to microservices.outbox table, published later by OutboxRelay,
+// with CryptoShredder data and metadata are encrypted like stored events and decrypted by the relay
+func (p *pgEventStore) saveOutboxTx(ctx context.Context, tx pgx.Tx, events []Event) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.saveOutboxTx")
+	defer span.Finish()
+
+	batch := &pgx.Batch{}
+	for _, event := range events {
+		data, metadata := event.GetData(), event.GetMetadata()
+		if p.shredder != nil {
+			var err error
+			if data, metadata, err = p.shredder.Encrypt(ctx, event, data); err != nil {
+				p.log.Errorf("(saveOutboxTx) shredder.Encrypt err: %v", err)
+				return tracing.TraceWithErr(span, errors.Wrap(err, "shredder.Encrypt"))
+			}
+		}
+
+		batch.Queue(
+			saveOutboxQuery,
+			event.GetEventID(),
+			event.GetAggregateID(),
+			event.GetAggregateType(),
+			event.GetEventType(),
+			data,
+			event.GetVersion(),
+			metadata,
+			event.GetTimeStamp(),
+			event.GetSchemaVersion(),
+		)
+	}
+
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		p.log.Errorf("(saveOutboxTx) tx.SendBatch err: %v", err)
+		return tracing.TraceWithErr(span, errors.Wrap(err, "tx.SendBatch"))
+	}
+
+	return nil
+}
+
 // SaveEvents save aggregate uncomitted events as one batch and process with event bus using transaction
 func (p *pgEventStore) SaveEvents(ctx context.Context, events []Event) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.SaveEvents")
@@ -83,56 +252,47 @@ func (p *pgEventStore) SaveEvents(ctx context.Context, events []Event) error {
 		return RollBackTx(ctx, tx, err)
 	}
 
-	// If aggregate changes has single event save it
-	if len(events) == 1 {
-		// Save Evnet to microservices.events table
-		result, err := tx.Exec(
-			ctx,
-			saveEventQuery,
-			events[0].GetAggregateID(),
-			events[0].GetAggregateType(),
-			events[0].GetEventType(),
-			events[0].GetData(),
-			events[0].GetVersion(),
-			events[0].GetMetadata(),
-		)
-		if err != nil {
-			p.log.Errorf("(SaveEvents) tx.Exac err: %v", tracing.TraceWithErr(span, err))
-			return RollBackTx(ctx, tx, err)
-		}
+	// reject events of closed or deleted stream
+	if err := p.checkStreamStateTx(ctx, tx, events[0].GetAggregateID()); err != nil {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, err))
+	}
 
-		// Add and Check events to kafka topic
-		if err := p.processEvents(ctx, events); err != nil {
-			return RollBackTx(ctx, tx, tracing.TraceWithErr(span, err))
-		}
+	// Save Evnet to microservices.events table
+	if err := p.saveEventsTx(ctx, tx, events); err != nil {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, err))
+	}
 
-		p.log.Debugf("(SaveEvents) result: %s, AggregateID: %s, AggregateVersion: %v", result.String(),
-			events[0].GetAggregateID, events[0].GetVersion())
-		return tx.Commit(ctx)
+	// Add and Check events to kafka topic or outbox
+	if err := p.processEventsTx(ctx, tx, events); err != nil {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, err))
 	}
 
-	// create batch query
-	batch := &pgx.Batch{}
-	for _, event := range events {
-		batch.Queue(
-			saveEventQuery,
-			event.GetAggregateID(),
-			event.GetAggregateType(),
-			event.GetEventType(),
-			event.GetData(),
-			event.GetVersion(),
-			event.GetMetadata(),
-		)
+	p.log.Debugf("(SaveEvents) AggregateID: %s, AggregateVersion: %v", events[0].GetAggregateID(), events[0].GetVersion())
+	return tx.Commit(ctx)
+}
+
+// AppendEvents append events to the aggregate stream checking expected stream version and process with event bus using transaction
+func (p *pgEventStore) AppendEvents(ctx context.Context, aggregateID string, expectedVersion ExpectedVersion, events []Event) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.AppendEvents")
+	defer span.Finish()
+	span.LogFields(log.String("aggregateID", aggregateID), log.String("expectedVersion", expectedVersion.String()))
+
+	if len(events) == 0 {
+		return nil
 	}
 
-	// Save Evnet to microservices.events table
-	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
-		p.log.Errorf("(SaveEvents) tx.SendBatch err: %v", tracing.TraceWithErr(span, err))
-		return RollBackTx(ctx, tx, err)
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		p.log.Errorf("(AppendEvents) db.Begin err: %v", err)
+		return tracing.TraceWithErr(span, errors.Wrap(err, "db.Begin"))
 	}
 
-	if err := p.processEvents(ctx, events); err != nil {
-		return RollBackTx(ctx, tx, err)
+	if err := p.appendEventsTx(ctx, tx, aggregateID, expectedVersion, events); err != nil {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, err))
+	}
+
+	if err := p.processEventsTx(ctx, tx, events); err != nil {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, errors.Wrap(err, "processEventsTx")))
 	}
 
 	return tx.Commit(ctx)
@@ -154,6 +314,7 @@ func (p *pgEventStore) LoadEvents(ctx context.Context, aggregateID string) ([]Ev
 
 	for rows.Next() {
 		var event Event
+		var dataCompression string
 		if err := rows.Scan(
 			&event.EventID,
 			&event.AggregateID,
@@ -163,39 +324,90 @@ func (p *pgEventStore) LoadEvents(ctx context.Context, aggregateID string) ([]Ev
 			&event.Version,
 			&event.Timestamp,
 			&event.Metadata,
+			&event.SchemaVersion,
+			&dataCompression,
 		); err != nil {
 			p.log.Errorf("(LoadEvents) rows.Next err: %v", tracing.TraceWithErr(span, err))
 			return nil, errors.Wrap(err, "rows.Scan")
 		}
 
-		events = append(events, event)
+		if err := p.decodeEventData(ctx, &event, CompressionAlgorithm(dataCompression)); err != nil {
+			p.log.Errorf("(LoadEvents) decodeEventData err: %v", err)
+			return nil, tracing.TraceWithErr(span, errors.Wrap(err, "decodeEventData"))
+		}
+
+		upcastedEvent, err := p.upcasters.Upcast(event)
+		if err != nil {
+			p.log.Errorf("(LoadEvents) upcasters.Upcast err: %v", err)
+			return nil, tracing.TraceWithErr(span, errors.Wrap(err, "upcasters.Upcast"))
+		}
+
+		events = append(events, upcastedEvent)
 	}
 
 	if err := rows.Err(); err != nil {
 		p.log.Errorf("(LoadEvents) rows.Err err: %v", tracing.TraceWithErr(span, err))
 		return nil, errors.Wrap(err, "rows.Err")
 	}
+	rows.Close()
 
-	return events, nil
+	// the last stream event is never archived, so archived events are the prefix before the first stored one
+	if len(events) == 0 || events[0].GetVersion() == 1 {
+		return events, nil
+	}
+
+	if p.archive == nil {
+		if err := p.archivedRangeErr(ctx, aggregateID, 0, events[0].GetVersion()-1); err != nil {
+			return nil, tracing.TraceWithErr(span, err)
+		}
+		return events, nil
+	}
+
+	archivedEvents, err := p.readArchivedEvents(ctx, p.db, aggregateID, 0, events[0].GetVersion()-1)
+	if err != nil {
+		p.log.Errorf("(LoadEvents) readArchivedEvents err: %v", err)
+		return nil, tracing.TraceWithErr(span, errors.Wrap(err, "readArchivedEvents"))
+	}
+	if uint64(len(archivedEvents)) != events[0].GetVersion()-1 {
+		return nil, tracing.TraceWithErr(span, errors.Wrapf(ErrInvalidEventVersion, "aggregateID: %s, archived events: %d, first stored version: %d",
+			aggregateID, len(archivedEvents), events[0].GetVersion()))
+	}
+
+	return append(archivedEvents, events...), nil
 }
 
-// loadEvents load aggregate events by aggregate
-func (p *pgEventStore) loadEvents(ctx context.Context, aggregate Aggregate) error {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.loadEvents")
+// ReadAll load events of the global $all stream after given position up to the settled head position
+func (p *pgEventStore) ReadAll(ctx context.Context, fromPosition uint64, limit int, filter ReadAllFilter) ([]Event, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.ReadAll")
 	defer span.Finish()
-	span.LogFields(log.String("aggregate", aggregate.String()))
+	span.LogFields(log.String("stream", constants.EsAll), log.Uint64("fromPosition", fromPosition), log.Int("limit", limit))
 
-	rows, err := p.db.Query(ctx, getEventsQuery, aggregate.GetID())
+	if limit <= 0 {
+		return nil, tracing.TraceWithErr(span, errors.Wrapf(ErrInvalidLimit, "limit: %d", limit))
+	}
+
+	headPosition, err := p.settledHeadPosition(ctx)
 	if err != nil {
-		p.log.Errorf("(loadEvents) db.Query err: %v", err)
-		return tracing.TraceWithErr(span, errors.Wrap(err, "db.Query"))
+		return nil, tracing.TraceWithErr(span, err)
+	}
+	if headPosition <= fromPosition {
+		return []Event{}, nil
+	}
+
+	rows, err := p.db.Query(ctx, readAllQuery, fromPosition, limit, filter.aggregateTypes(), filter.eventTypes(), filter.from(), filter.to(), headPosition)
+	if err != nil {
+		p.log.Errorf("(ReadAll) db.Query err: %v", err)
+		return nil, tracing.TraceWithErr(span, errors.Wrap(err, "db.Query"))
 	}
 	defer rows.Close()
 
+	events := make([]Event, 0, limit)
+
 	for rows.Next() {
 		var event Event
-
+		var dataCompression string
 		if err := rows.Scan(
+			&event.Position,
 			&event.EventID,
 			&event.AggregateID,
 			&event.AggregateType,
@@ -204,30 +416,90 @@ func (p *pgEventStore) loadEvents(ctx context.Context, aggregate Aggregate) erro
 			&event.Version,
 			&event.Timestamp,
 			&event.Metadata,
+			&event.SchemaVersion,
+			&dataCompression,
 		); err != nil {
-			p.log.Errorf("(loadEvents) rows.Next err: %v", err)
-			return tracing.TraceWithErr(span, errors.Wrap(err, "rows.Scan"))
+			p.log.Errorf("(ReadAll) rows.Scan err: %v", err)
+			return nil, tracing.TraceWithErr(span, errors.Wrap(err, "rows.Scan"))
 		}
 
-		deserilizedEvent, err := p.serializer.DeserializeEvent(event)
-		if err != nil {
-			p.log.Errorf("(loadEvents) serializer.DeserializeEvent err: %v", err)
-			return tracing.TraceWithErr(span, errors.Wrap(err, "serializer.DeserializeEvent"))
+		if err := p.decodeEventData(ctx, &event, CompressionAlgorithm(dataCompression)); err != nil {
+			p.log.Errorf("(ReadAll) decodeEventData err: %v", err)
+			return nil, tracing.TraceWithErr(span, errors.Wrap(err, "decodeEventData"))
 		}
 
-		if err := aggregate.RaiseEvent(deserilizedEvent); err != nil {
-			p.log.Errorf("(loadEvents) aggregate.RaiseEvent err: %v", err)
-			return tracing.TraceWithErr(span, errors.Wrap(err, "RaiseEvent"))
+		upcastedEvent, err := p.upcasters.Upcast(event)
+		if err != nil {
+			p.log.Errorf("(ReadAll) upcasters.Upcast err: %v", err)
+			return nil, tracing.TraceWithErr(span, errors.Wrap(err, "upcasters.Upcast"))
 		}
+
+		events = append(events, upcastedEvent)
 	}
 
 	if err := rows.Err(); err != nil {
-		p.log.Errorf("(loadEvents) rows.Err err: %v", err)
-		return tracing.TraceWithErr(span, errors.Wrap(err, "rows.Err"))
+		p.log.Errorf("(ReadAll) rows.Err err: %v", err)
+		return nil, tracing.TraceWithErr(span, errors.Wrap(err, "rows.Err"))
 	}
 
-	span.LogFields(log.String("aggregate with events", aggregate.String()))
-	return nil
+	span.LogFields(log.Int("events", len(events)))
+	return events, nil
+}
+
+// settledHeadPosition last position of the $all stream below which no position can be committed anymore.
+// Concurrent writers commit positions out of order, so gap below the last visible position may be filled later
+// by a writer still in flight. Writers running when the head was read are awaited, after them gaps are final.
+func (p *pgEventStore) settledHeadPosition(ctx context.Context) (uint64, error) {
+	var headPosition uint64
+	if err := p.db.QueryRow(ctx, getLastPositionQuery).Scan(&headPosition); err != nil {
+		p.log.Errorf("(settledHeadPosition) db.QueryRow err: %v", err)
+		return 0, errors.Wrap(err, "db.QueryRow")
+	}
+
+	var writers []string
+	if err := p.db.QueryRow(ctx, getEventWritersQuery).Scan(&writers); err != nil {
+		p.log.Errorf("(settledHeadPosition) db.QueryRow err: %v", err)
+		return 0, errors.Wrap(err, "db.QueryRow")
+	}
+	if len(writers) == 0 {
+		return headPosition, nil
+	}
+
+	timeout := time.NewTimer(readAllSettleTimeout)
+	defer timeout.Stop()
+
+	for {
+		var active int
+		if err := p.db.QueryRow(ctx, countEventWritersQuery, writers).Scan(&active); err != nil {
+			p.log.Errorf("(settledHeadPosition) db.QueryRow err: %v", err)
+			return 0, errors.Wrap(err, "db.QueryRow")
+		}
+		if active == 0 {
+			return headPosition, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-timeout.C:
+			return 0, errors.Wrapf(ErrReadAllNotSettled, "writers in flight: %d, timeout: %s", active, readAllSettleTimeout)
+		case <-time.After(readAllSettlePollInterval):
+		}
+	}
+}
+
+// GetLastPosition load position of the last event in the global $all stream
+func (p *pgEventStore) GetLastPosition(ctx context.Context) (uint64, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.GetLastPosition")
+	defer span.Finish()
+
+	var position uint64
+	if err := p.db.QueryRow(ctx, getLastPositionQuery).Scan(&position); err != nil {
+		p.log.Errorf("(GetLastPosition) db.QueryRow err: %v", err)
+		return 0, tracing.TraceWithErr(span, errors.Wrap(err, "db.QueryRow"))
+	}
+
+	return position, nil
 }
 
 // Exists check for exists aggregate by id
@@ -264,6 +536,7 @@ func (p *pgEventStore) loadEventsByVersion(ctx context.Context, aggregateID stri
 
 	for rows.Next() {
 		var event Event
+		var dataCompression string
 
 		if err := rows.Scan(
 			&event.EventID,
@@ -274,11 +547,18 @@ func (p *pgEventStore) loadEventsByVersion(ctx context.Context, aggregateID stri
 			&event.Version,
 			&event.Timestamp,
 			&event.Metadata,
+			&event.SchemaVersion,
+			&dataCompression,
 		); err != nil {
 			p.log.Errorf("(loadEventByVersion) rows.Next err: %v", err)
 			return nil, errors.Wrap(err, "rows.Scan")
 		}
 
+		if err := p.decodeEventData(ctx, &event, CompressionAlgorithm(dataCompression)); err != nil {
+			p.log.Errorf("(loadEventByVersion) decodeEventData err: %v", err)
+			return nil, tracing.TraceWithErr(span, errors.Wrap(err, "decodeEventData"))
+		}
+
 		events = append(events, event)
 	}
 
@@ -291,12 +571,13 @@ func (p *pgEventStore) loadEventsByVersion(ctx context.Context, aggregateID stri
 
 }
 
-func (p *pgEventStore) loadAggregateEventsByVersion(ctx context.Context, aggregate Aggregate) error {
+// loadAggregateEventsByVersion raise aggregate events after current aggregate version up to toVersion
+func (p *pgEventStore) loadAggregateEventsByVersion(ctx context.Context, q pgQuerier, aggregate Aggregate, toVersion uint64) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.loadAggregateEventsByVersion")
 	defer span.Finish()
-	span.LogFields(log.String("aggregate", aggregate.String()))
+	span.LogFields(log.String("aggregate", aggregate.String()), log.Uint64("toVersion", toVersion))
 
-	rows, err := p.db.Query(ctx, getEventsByVersionQuery, aggregate.GetID(), aggregate.GetVersion())
+	rows, err := q.Query(ctx, getEventsByVersionRangeQuery, aggregate.GetID(), aggregate.GetVersion(), toVersion)
 	if err != nil {
 		p.log.Errorf("(loadAggregateEventsByVersion) db.Query err: %v", err)
 		return errors.Wrap(err, "db.Query")
@@ -305,6 +586,7 @@ func (p *pgEventStore) loadAggregateEventsByVersion(ctx context.Context, aggrega
 
 	for rows.Next() {
 		var event Event
+		var dataCompression string
 
 		if err := rows.Scan(
 			&event.EventID,
@@ -315,12 +597,31 @@ func (p *pgEventStore) loadAggregateEventsByVersion(ctx context.Context, aggrega
 			&event.Version,
 			&event.Timestamp,
 			&event.Metadata,
+			&event.SchemaVersion,
+			&dataCompression,
 		); err != nil {
 			p.log.Errorf("(loadAggregateEventsByVersion) rows.Next err: %v", err)
 			return tracing.TraceWithErr(span, errors.Wrap(err, "rows.Scan"))
 		}
 
-		deserializedEvent, err := p.serializer.DeserializeEvent(event)
+		// events before the first stored one were archived and can not be skipped
+		if event.GetVersion() != aggregate.GetVersion()+1 {
+			return tracing.TraceWithErr(span, errors.Wrapf(ErrInvalidEventVersion, "aggregateID: %s, expected version: %d, event version: %d",
+				aggregate.GetID(), aggregate.GetVersion()+1, event.GetVersion()))
+		}
+
+		if err := p.decodeEventData(ctx, &event, CompressionAlgorithm(dataCompression)); err != nil {
+			p.log.Errorf("(loadAggregateEventsByVersion) decodeEventData err: %v", err)
+			return tracing.TraceWithErr(span, errors.Wrap(err, "decodeEventData"))
+		}
+
+		upcastedEvent, err := p.upcasters.Upcast(event)
+		if err != nil {
+			p.log.Errorf("(loadAggregateEventsByVersion) upcasters.Upcast err: %v", err)
+			return tracing.TraceWithErr(span, errors.Wrap(err, "upcasters.Upcast"))
+		}
+
+		deserializedEvent, err := p.deserializeEvent(upcastedEvent)
 		if err != nil {
 			p.log.Errorf("(loadAggregateEventsByVersion) serializer.DeserializeEvent err: %v", err)
 			return tracing.TraceWithErr(span, errors.Wrap(err, "serializer.DeserializeEvent"))
@@ -359,6 +660,7 @@ func (p *pgEventStore) loadEventsByVersionTx(ctx context.Context, tx pgx.Tx, agg
 
 	for rows.Next() {
 		var event Event
+		var dataCompression string
 
 		if err := rows.Scan(
 			&event.EventID,
@@ -369,11 +671,18 @@ func (p *pgEventStore) loadEventsByVersionTx(ctx context.Context, tx pgx.Tx, agg
 			&event.Version,
 			&event.Timestamp,
 			&event.Metadata,
+			&event.SchemaVersion,
+			&dataCompression,
 		); err != nil {
 			p.log.Errorf("(loadEventsByVersionTx) rows.Next err: %v", err)
 			return nil, tracing.TraceWithErr(span, errors.Wrap(err, "rows.Scan"))
 		}
 
+		if err := p.decodeEventData(ctx, &event, CompressionAlgorithm(dataCompression)); err != nil {
+			p.log.Errorf("(loadEventsByVersionTx) decodeEventData err: %v", err)
+			return nil, tracing.TraceWithErr(span, errors.Wrap(err, "decodeEventData"))
+		}
+
 		events = append(events, event)
 
 	}
@@ -386,14 +695,117 @@ func (p *pgEventStore) loadEventsByVersionTx(ctx context.Context, tx pgx.Tx, agg
 	return events, nil
 }
 
-func (p *pgEventStore) saveEventsTx(ctx context.Context, tx pgx.Tx, events []Event) error {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.saveEventsTx")
+// decodeEventData decrypt and decompress stored event data in place.
+func (p *pgEventStore) decodeEventData(ctx context.Context, event *Event, dataCompression CompressionAlgorithm) error {
+	if p.shredder != nil {
+		if err := p.shredder.Decrypt(ctx, event); err != nil {
+			return errors.Wrap(err, "shredder.Decrypt")
+		}
+	} else if event.isEncrypted() {
+		return errors.Wrapf(ErrCryptoShredderNotConfigured, "eventID: %s, aggregateID: %s, version: %d", event.GetEventID(), event.GetAggregateID(), event.GetVersion())
+	}
+
+	if event.IsForgotten() {
+		return nil
+	}
+
+	data, err := decompress(event.GetData(), dataCompression)
+	if err != nil {
+		return errors.Wrap(err, "decompress")
+	}
+	event.Data = data
+	return nil
+}
+
+// deserializeEvent deserialize loaded event, forgotten events are returned as *ForgottenEvent.
+func (p *pgEventStore) deserializeEvent(event Event) (any, error) {
+	if event.IsForgotten() {
+		return &ForgottenEvent{Event: event}, nil
+	}
+	return p.serializer.DeserializeEvent(event)
+}
+
+// appendEventsTx lock the aggregate stream, check expected version and save events numbered from the current stream version
+func (p *pgEventStore) appendEventsTx(ctx context.Context, tx pgx.Tx, aggregateID string, expectedVersion ExpectedVersion, events []Event) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.appendEventsTx")
 	defer span.Finish()
 
+	for i := range events {
+		if events[i].GetAggregateID() != aggregateID {
+			return tracing.TraceWithErr(span, errors.Wrapf(ErrInvalidAggregateID, "event aggregateID: %s, stream aggregateID: %s", events[i].GetAggregateID(), aggregateID))
+		}
+	}
+
 	if err := p.handleConcurrency(ctx, tx, events); err != nil {
 		return err
 	}
 
+	if err := p.checkStreamStateTx(ctx, tx, aggregateID); err != nil {
+		return tracing.TraceWithErr(span, err)
+	}
+
+	currentVersion, exists, err := p.getStreamVersionTx(ctx, tx, aggregateID)
+	if err != nil {
+		return err
+	}
+
+	if err := expectedVersion.Check(currentVersion, exists); err != nil {
+		p.log.Warnf("(appendEventsTx) aggregateID: %s, err: %v", aggregateID, err)
+		return tracing.TraceWithErr(span, err)
+	}
+
+	for i := range events {
+		events[i].SetVersion(currentVersion + uint64(i) + 1)
+	}
+
+	return p.saveEventsTx(ctx, tx, events)
+}
+
+// lockEventWriterTx mark transaction as event writer until commit with shared advisory lock taken before positions are assigned,
+// writers stay concurrent and ReadAll waits for the writers which may still commit positions below the read head
+func (p *pgEventStore) lockEventWriterTx(ctx context.Context, tx pgx.Tx) error {
+	if _, err := tx.Exec(ctx, lockEventWriterQuery); err != nil {
+		p.log.Errorf("(lockEventWriterTx) tx.Exec err: %v", err)
+		return errors.Wrap(err, "tx.Exec")
+	}
+	return nil
+}
+
+func (p *pgEventStore) saveEventsTx(ctx context.Context, tx pgx.Tx, events []Event) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.saveEventsTx")
+	defer span.Finish()
+
+	if err := p.lockEventWriterTx(ctx, tx); err != nil {
+		return tracing.TraceWithErr(span, err)
+	}
+
+	data := make([][]byte, len(events))
+	metadata := make([][]byte, len(events))
+	dataCompression := make([]CompressionAlgorithm, len(events))
+	for i := range events {
+		// the same event id is written to the outbox and published, so consumers can match them with stored events
+		if events[i].GetEventID() == "" {
+			events[i].EventID = uuid.NewV4().String()
+		}
+		if events[i].GetSchemaVersion() == 0 {
+			events[i].SetSchemaVersion(p.upcasters.CurrentVersion(events[i].GetEventType()))
+		}
+
+		compressed, algorithm, err := p.cfg.Compression.compress(events[i].GetData())
+		if err != nil {
+			p.log.Errorf("(saveEventsTx) compress err: %v", err)
+			return tracing.TraceWithErr(span, errors.Wrap(err, "compress"))
+		}
+		data[i], metadata[i], dataCompression[i] = compressed, events[i].GetMetadata(), algorithm
+
+		if p.shredder != nil {
+			if data[i], metadata[i], err = p.shredder.Encrypt(ctx, events[i], compressed); err != nil {
+				p.log.Errorf("(saveEventsTx) shredder.Encrypt err: %v", err)
+				return tracing.TraceWithErr(span, errors.Wrap(err, "shredder.Encrypt"))
+			}
+		}
+	}
+
 	if len(events) == 1 {
 		result, err := tx.Exec(
 			ctx,
@@ -401,12 +813,18 @@ func (p *pgEventStore) saveEventsTx(ctx context.Context, tx pgx.Tx, events []Eve
 			events[0].GetAggregateID(),
 			events[0].GetAggregateType(),
 			events[0].GetEventType(),
-			events[0].GetData(),
+			data[0],
 			events[0].GetVersion(),
-			events[0].GetMetadata(),
+			metadata[0],
+			events[0].GetSchemaVersion(),
+			string(dataCompression[0]),
+			events[0].GetEventID(),
 		)
 		if err != nil {
 			p.log.Errorf("(saveEventsTx) tx.Exec err: %v", err)
+			if isUniqueViolation(err) {
+				return tracing.TraceWithErr(span, newConcurrencyConflictError(err))
+			}
 			return tracing.TraceWithErr(span, errors.Wrap(err, "tx.Exec"))
 		}
 
@@ -415,20 +833,26 @@ func (p *pgEventStore) saveEventsTx(ctx context.Context, tx pgx.Tx, events []Eve
 	}
 
 	batch := &pgx.Batch{}
-	for _, event := range events {
+	for i, event := range events {
 		batch.Queue(
 			saveEventQuery,
 			event.GetAggregateID(),
 			event.GetAggregateType(),
 			event.GetEventType(),
-			event.GetData(),
+			data[i],
 			event.GetVersion(),
-			event.GetMetadata(),
+			metadata[i],
+			event.GetSchemaVersion(),
+			string(dataCompression[i]),
+			event.GetEventID(),
 		)
 	}
 
 	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
 		p.log.Errorf("(saveEventsTx) tx.SendBatch err: %v", err)
+		if isUniqueViolation(err) {
+			return tracing.TraceWithErr(span, newConcurrencyConflictError(err))
+		}
 		return tracing.TraceWithErr(span, errors.Wrap(err, "tx.SendBatch"))
 	}
 
@@ -446,7 +870,17 @@ func (p *pgEventStore) saveSnapshotTx(ctx context.Context, tx pgx.Tx, aggregate
 		return err
 	}
 
-	_, err = tx.Exec(ctx, saveSnapshotQuery, snapshot.ID, snapshot.Type, snapshot.State, snapshot.Version)
+	state, stateCompression, subjectID, err := p.encodeSnapshotState(ctx, snapshot)
+	if errors.Is(err, ErrSubjectForgotten) {
+		p.log.Debugf("(saveSnapshotTx) skipped snapshot of forgotten subject, aggregateID: %s", snapshot.ID)
+		return nil
+	}
+	if err != nil {
+		p.log.Errorf("(saveSnapshotTx) encodeSnapshotState err: %v", err)
+		return tracing.TraceWithErr(span, errors.Wrap(err, "encodeSnapshotState"))
+	}
+
+	_, err = tx.Exec(ctx, saveSnapshotQuery, snapshot.ID, snapshot.Type, state, snapshot.Version, snapshot.SchemaVersion, string(stateCompression), subjectID)
 	if err != nil {
 		p.log.Errorf("(saveSnapshotTx) tx.Exec err: %v", err)
 		return tracing.TraceWithErr(span, errors.Wrap(err, "tx.Exec"))
@@ -6,3 +6,9 @@ import "context"
 type Projection interface {
 	When(ctx context.Context, event Event) error
 }
+
+// ResettableProjection Reset method clear read database of the Projection before it is rebuilt from the event store.
+type ResettableProjection interface {
+	Projection
+	Reset(ctx context.Context) error
+}
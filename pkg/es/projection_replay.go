@@ -0,0 +1,182 @@
+package es
+
+import (
+	"context"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+const (
+	defaultReplayBatchSize = 500
+	defaultReplayPoolSize  = 1
+)
+
+// ProjectionReplayConfig projection replay config, Name is the checkpoint name used by projection subscription.
+type ProjectionReplayConfig struct {
+	Name      string        `mapstructure:"name" validate:"required"`
+	BatchSize int           `mapstructure:"batchSize" validate:"gte=0"`
+	PoolSize  int           `mapstructure:"poolSize" validate:"gte=0"`
+	Filter    ReadAllFilter `mapstructure:"-"`
+}
+
+// ReplayProgress progress of running projection replay.
+type ReplayProgress struct {
+	Name         string
+	Position     uint64
+	HeadPosition uint64
+	Processed    uint64
+	Elapsed      time.Duration
+}
+
+// Percent processed part of the $all stream up to head position captured when replay started.
+func (p ReplayProgress) Percent() float64 {
+	if p.HeadPosition == 0 {
+		return 100
+	}
+	return float64(p.Position) / float64(p.HeadPosition) * 100
+}
+
+// ReplayProgressFunc called after each processed batch.
+type ReplayProgressFunc func(progress ReplayProgress)
+
+// ProjectionReplayer rebuild projection read model from all events of the event store.
+// Projection subscription must be stopped while replay is running.
+// Events moved to ArchiveStore by ArchiveStream are not replayed, archived history must be replayed from the archive.
+type ProjectionReplayer struct {
+	log             logger.Logger
+	cfg             ProjectionReplayConfig
+	eventStore      EventStore
+	checkpointStore CheckpointStore
+	projection      ResettableProjection
+	progress        ReplayProgressFunc
+}
+
+// NewProjectionReplayer ProjectionReplayer constructor, progress func is optional.
+func NewProjectionReplayer(
+	log logger.Logger,
+	cfg ProjectionReplayConfig,
+	eventStore EventStore,
+	checkpointStore CheckpointStore,
+	projection ResettableProjection,
+	progress ReplayProgressFunc,
+) *ProjectionReplayer {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultReplayBatchSize
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = defaultReplayPoolSize
+	}
+
+	return &ProjectionReplayer{
+		log:             log,
+		cfg:             cfg,
+		eventStore:      eventStore,
+		checkpointStore: checkpointStore,
+		projection:      projection,
+		progress:        progress,
+	}
+}
+
+// Rebuild reset projection storage and checkpoint, then replay all events.
+func (r *ProjectionReplayer) Rebuild(ctx context.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ProjectionReplayer.Rebuild")
+	defer span.Finish()
+	span.LogFields(log.String("projection", r.cfg.Name))
+
+	if err := r.projection.Reset(ctx); err != nil {
+		r.log.Errorf("(ProjectionReplayer) name: %s, projection.Reset err: %v", r.cfg.Name, err)
+		return tracing.TraceWithErr(span, errors.Wrap(err, "projection.Reset"))
+	}
+
+	if err := r.checkpointStore.SaveCheckpoint(ctx, r.cfg.Name, 0); err != nil {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "checkpointStore.SaveCheckpoint"))
+	}
+
+	r.log.Infof("(ProjectionReplayer) name: %s storage and checkpoint reset", r.cfg.Name)
+	return tracing.TraceWithErr(span, r.Resume(ctx))
+}
+
+// Resume continue replay from the stored checkpoint, used after crash of running Rebuild.
+func (r *ProjectionReplayer) Resume(ctx context.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ProjectionReplayer.Resume")
+	defer span.Finish()
+
+	position, err := r.checkpointStore.GetCheckpoint(ctx, r.cfg.Name)
+	if err != nil {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "checkpointStore.GetCheckpoint"))
+	}
+
+	headPosition, err := r.eventStore.GetLastPosition(ctx)
+	if err != nil {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "eventStore.GetLastPosition"))
+	}
+
+	r.log.Infof("(Starting ProjectionReplayer) name: %s, position: %d, headPosition: %d, poolSize: %d", r.cfg.Name, position, headPosition, r.cfg.PoolSize)
+
+	handler := PartitionByAggregate(r.cfg.PoolSize, r.handle)
+	progress := ReplayProgress{Name: r.cfg.Name, Position: position, HeadPosition: headPosition}
+	started := time.Now()
+
+	for progress.Position < headPosition {
+		events, err := r.eventStore.ReadAll(ctx, progress.Position, r.cfg.BatchSize, r.cfg.Filter)
+		if err != nil {
+			return tracing.TraceWithErr(span, errors.Wrap(err, "eventStore.ReadAll"))
+		}
+
+		// events appended after replay started are processed by projection subscription
+		for len(events) > 0 && events[len(events)-1].GetPosition() > headPosition {
+			events = events[:len(events)-1]
+		}
+		if len(events) == 0 {
+			break
+		}
+
+		if err := handler(ctx, events); err != nil {
+			r.log.Errorf("(ProjectionReplayer) name: %s, position: %d, err: %v", r.cfg.Name, progress.Position, err)
+			return tracing.TraceWithErr(span, err)
+		}
+
+		progress.Position = events[len(events)-1].GetPosition()
+		if err := r.checkpointStore.SaveCheckpoint(ctx, r.cfg.Name, progress.Position); err != nil {
+			return tracing.TraceWithErr(span, errors.Wrap(err, "checkpointStore.SaveCheckpoint"))
+		}
+
+		progress.Processed += uint64(len(events))
+		progress.Elapsed = time.Since(started)
+		r.reportProgress(progress)
+	}
+
+	// filtered replay may stop before head, move checkpoint so subscription does not reprocess skipped events
+	if progress.Position < headPosition {
+		if err := r.checkpointStore.SaveCheckpoint(ctx, r.cfg.Name, headPosition); err != nil {
+			return tracing.TraceWithErr(span, errors.Wrap(err, "checkpointStore.SaveCheckpoint"))
+		}
+		progress.Position = headPosition
+	}
+
+	progress.Elapsed = time.Since(started)
+	r.reportProgress(progress)
+	r.log.Infof("(ProjectionReplayer) name: %s finished, processed: %d, elapsed: %s", r.cfg.Name, progress.Processed, progress.Elapsed)
+	return nil
+}
+
+func (r *ProjectionReplayer) handle(ctx context.Context, events []Event) error {
+	for _, event := range events {
+		if err := r.projection.When(ctx, event); err != nil {
+			return errors.Wrapf(err, "projection.When eventType: %s, position: %d", event.GetEventType(), event.GetPosition())
+		}
+	}
+	return nil
+}
+
+func (r *ProjectionReplayer) reportProgress(progress ReplayProgress) {
+	r.log.Debugf("(ProjectionReplayer) name: %s, position: %d/%d, processed: %d", progress.Name, progress.Position, progress.HeadPosition, progress.Processed)
+	if r.progress != nil {
+		r.progress(progress)
+	}
+}
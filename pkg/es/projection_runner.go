@@ -0,0 +1,110 @@
+package es
+
+import (
+	"context"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+const (
+	defaultProjectionPoolSize     = 1
+	defaultProjectionMaxAttempts  = 3
+	defaultProjectionRetryBackoff = 300 * time.Millisecond
+)
+
+// ProjectionRunnerConfig projection runner config
+type ProjectionRunnerConfig struct {
+	Name         string        `mapstructure:"name" validate:"required"`
+	PoolSize     int           `mapstructure:"poolSize" validate:"gte=0"`
+	MaxAttempts  int           `mapstructure:"maxAttempts" validate:"gte=0"`
+	RetryBackoff time.Duration `mapstructure:"retryBackoff"`
+	// SkipFailedEvents log and skip event after all attempts failed, otherwise runner stops with error.
+	SkipFailedEvents bool `mapstructure:"skipFailedEvents"`
+}
+
+// ProjectionRunner drive Projection with events delivered by ProjectionSource.
+type ProjectionRunner struct {
+	log        logger.Logger
+	cfg        ProjectionRunnerConfig
+	projection Projection
+	source     ProjectionSource
+}
+
+// NewProjectionRunner ProjectionRunner constructor.
+func NewProjectionRunner(log logger.Logger, cfg ProjectionRunnerConfig, projection Projection, source ProjectionSource) *ProjectionRunner {
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = defaultProjectionPoolSize
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultProjectionMaxAttempts
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = defaultProjectionRetryBackoff
+	}
+
+	return &ProjectionRunner{
+		log:        log,
+		cfg:        cfg,
+		projection: projection,
+		source:     source,
+	}
+}
+
+// Run process events from source until context is done or event failed with SkipFailedEvents disabled.
+func (r *ProjectionRunner) Run(ctx context.Context) error {
+	r.log.Infof("(Starting ProjectionRunner) name: %s, poolSize: %d, maxAttempts: %d", r.cfg.Name, r.cfg.PoolSize, r.cfg.MaxAttempts)
+
+	err := r.source.Run(ctx, r.cfg.PoolSize, r.HandleEvents)
+	if ctx.Err() != nil {
+		r.log.Infof("(ProjectionRunner) name: %s stopped: %v", r.cfg.Name, ctx.Err())
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// HandleEvents apply events to projection in order, can be used as SubscriptionHandler.
+func (r *ProjectionRunner) HandleEvents(ctx context.Context, events []Event) error {
+	for _, event := range events {
+		if err := r.when(ctx, event); err != nil {
+			if !r.cfg.SkipFailedEvents || ctx.Err() != nil {
+				return err
+			}
+			r.log.Errorf("(ProjectionRunner) name: %s skipped event: %s, err: %v", r.cfg.Name, event.String(), err)
+		}
+	}
+
+	return nil
+}
+
+// when apply event to projection retrying with linear backoff.
+func (r *ProjectionRunner) when(ctx context.Context, event Event) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ProjectionRunner.When")
+	defer span.Finish()
+	span.LogFields(log.String("projection", r.cfg.Name), log.String("eventType", string(event.GetEventType())), log.String("aggregateID", event.GetAggregateID()))
+
+	var err error
+	for attempt := 1; attempt <= r.cfg.MaxAttempts; attempt++ {
+		if err = r.projection.When(ctx, event); err == nil {
+			return nil
+		}
+
+		r.log.Warnf("(ProjectionRunner) name: %s, attempt: %d, eventType: %s, aggregateID: %s, err: %v", r.cfg.Name, attempt, event.GetEventType(), event.GetAggregateID(), err)
+		if attempt == r.cfg.MaxAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return tracing.TraceWithErr(span, ctx.Err())
+		case <-time.After(time.Duration(attempt) * r.cfg.RetryBackoff):
+		}
+	}
+
+	return tracing.TraceWithErr(span, errors.Wrapf(err, "projection.When eventType: %s", event.GetEventType()))
+}
@@ -0,0 +1,193 @@
+package es
+
+import (
+	"context"
+	"hash/fnv"
+
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
+	kafkaClient "github.com/saeed903/microservice_eventsourcing_package/pkg/kafka"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+	"github.com/segmentio/kafka-go"
+	"golang.org/x/sync/errgroup"
+)
+
+// ProjectionSource deliver events to the handler with given pool size until context is done.
+type ProjectionSource interface {
+	Run(ctx context.Context, poolSize int, handler SubscriptionHandler) error
+}
+
+type kafkaProjectionSource struct {
+	log           logger.Logger
+	consumerGroup kafkaClient.ConsumerGroup
+	topics        []string
+	upcasters     *UpcasterRegistry
+}
+
+// KafkaProjectionSourceOption optional kafkaProjectionSource dependency.
+type KafkaProjectionSourceOption func(s *kafkaProjectionSource)
+
+// WithProjectionUpcasters upcast consumed events with given registry before handler, like event store does on read.
+func WithProjectionUpcasters(upcasters *UpcasterRegistry) KafkaProjectionSourceOption {
+	return func(s *kafkaProjectionSource) {
+		if upcasters != nil {
+			s.upcasters = upcasters
+		}
+	}
+}
+
+// NewKafkaProjectionSource ProjectionSource consuming []Event or CloudEvents messages published by KafkaEventsBus.
+func NewKafkaProjectionSource(log logger.Logger, consumerGroup kafkaClient.ConsumerGroup, topics []string, opts ...KafkaProjectionSourceOption) *kafkaProjectionSource {
+	s := &kafkaProjectionSource{
+		log:           log,
+		consumerGroup: consumerGroup,
+		topics:        topics,
+		upcasters:     NewUpcasterRegistry(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Run consume topics with poolSize group members, each with own reader, so every partition is processed and committed
+// by one worker in order, message offset is committed after handler processed all message events.
+func (s *kafkaProjectionSource) Run(ctx context.Context, poolSize int, handler SubscriptionHandler) error {
+	if poolSize <= 0 {
+		poolSize = 1
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < poolSize; i++ {
+		worker := s.worker(i, handler)
+		g.Go(func() error {
+			return s.consumerGroup.ConsumeTopicWithErrGroup(ctx, s.topics, 1, worker)
+		})
+	}
+	return g.Wait()
+}
+
+func (s *kafkaProjectionSource) worker(workerID int, handler SubscriptionHandler) kafkaClient.WorkerErrGroup {
+	return func(ctx context.Context, r *kafka.Reader, _ int) error {
+		for {
+			m, err := r.FetchMessage(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				s.log.Warnf("(kafkaProjectionSource) workerID: %d, r.FetchMessage err: %v", workerID, err)
+				return errors.Wrap(err, "r.FetchMessage")
+			}
+
+			s.log.KafkaProcessMessage(m.Topic, m.Partition, m.Value, workerID, m.Offset, m.Time)
+			if err := s.processMessage(ctx, m, handler); err != nil {
+				return err
+			}
+
+			if err := r.CommitMessages(ctx, m); err != nil {
+				s.log.Errorf("(kafkaProjectionSource) workerID: %d, r.CommitMessages err: %v", workerID, err)
+				return errors.Wrap(err, "r.CommitMessages")
+			}
+			s.log.KafkaLogCommittedMessage(m.Topic, m.Partition, m.Offset)
+		}
+	}
+}
+
+func (s *kafkaProjectionSource) processMessage(ctx context.Context, m kafka.Message, handler SubscriptionHandler) error {
+	ctx, span := tracing.StratKafkaConsumerTracerSpan(ctx, m.Headers, "kafkaProjectionSource.processMessage")
+	defer span.Finish()
+
+	if IsCloudEvent(m.Headers) {
+		event, err := DecodeCloudEvent(m)
+		if err != nil {
+			s.log.Errorf("(kafkaProjectionSource) DecodeCloudEvent topic: %s, offset: %d, err: %v", m.Topic, m.Offset, err)
+			return tracing.TraceWithErr(span, errors.Wrap(err, "DecodeCloudEvent"))
+		}
+		return tracing.TraceWithErr(span, s.handle(ctx, []Event{event}, handler))
+	}
+
+	events := make([]Event, 0, eventsCapacity)
+	if err := serializer.Unmarshal(m.Value, &events); err != nil {
+		s.log.Errorf("(kafkaProjectionSource) serializer.Unmarshal topic: %s, offset: %d, err: %v", m.Topic, m.Offset, err)
+		return tracing.TraceWithErr(span, errors.Wrap(err, "serializer.Unmarshal"))
+	}
+
+	return tracing.TraceWithErr(span, s.handle(ctx, events, handler))
+}
+
+// handle upcast consumed events and process them with handler.
+func (s *kafkaProjectionSource) handle(ctx context.Context, events []Event, handler SubscriptionHandler) error {
+	for i := range events {
+		upcastedEvent, err := s.upcasters.Upcast(events[i])
+		if err != nil {
+			s.log.Errorf("(kafkaProjectionSource) upcasters.Upcast eventID: %s, err: %v", events[i].GetEventID(), err)
+			return errors.Wrap(err, "upcasters.Upcast")
+		}
+		events[i] = upcastedEvent
+	}
+
+	return handler(ctx, events)
+}
+
+type eventStoreProjectionSource struct {
+	log             logger.Logger
+	cfg             SubscriptionConfig
+	eventStore      EventStore
+	checkpointStore CheckpointStore
+}
+
+// NewEventStoreProjectionSource ProjectionSource reading the $all stream with persistent catch-up Subscription.
+// Handler errors stop Run by default, ProjectionRunner already retried and skipped failed events,
+// set cfg.MaxHandlerAttempts to retry failed batches.
+func NewEventStoreProjectionSource(log logger.Logger, cfg SubscriptionConfig, eventStore EventStore, checkpointStore CheckpointStore) *eventStoreProjectionSource {
+	if cfg.MaxHandlerAttempts <= 0 {
+		cfg.MaxHandlerAttempts = 1
+	}
+
+	return &eventStoreProjectionSource{
+		log:             log,
+		cfg:             cfg,
+		eventStore:      eventStore,
+		checkpointStore: checkpointStore,
+	}
+}
+
+// Run start subscription, events of each batch are partitioned by aggregate id between pool workers.
+func (s *eventStoreProjectionSource) Run(ctx context.Context, poolSize int, handler SubscriptionHandler) error {
+	return NewSubscription(s.log, s.cfg, s.eventStore, s.checkpointStore, PartitionByAggregate(poolSize, handler)).Run(ctx)
+}
+
+// PartitionByAggregate split events between poolSize concurrent handlers by aggregate id,
+// events of one aggregate are always processed by the same handler in original order.
+func PartitionByAggregate(poolSize int, handler SubscriptionHandler) SubscriptionHandler {
+	if poolSize <= 1 {
+		return handler
+	}
+
+	return func(ctx context.Context, events []Event) error {
+		partitions := make([][]Event, poolSize)
+		for _, event := range events {
+			idx := aggregatePartition(event.GetAggregateID(), poolSize)
+			partitions[idx] = append(partitions[idx], event)
+		}
+
+		g, ctx := errgroup.WithContext(ctx)
+		for _, partition := range partitions {
+			if len(partition) == 0 {
+				continue
+			}
+			partition := partition
+			g.Go(func() error {
+				return handler(ctx, partition)
+			})
+		}
+		return g.Wait()
+	}
+}
+
+func aggregatePartition(aggregateID string, poolSize int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(aggregateID))
+	return int(h.Sum32() % uint32(poolSize))
+}
@@ -0,0 +1,97 @@
+package es
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestPartitionByAggregate(t *testing.T) {
+	events := make([]Event, 0, 30)
+	for i := 0; i < 30; i++ {
+		events = append(events, Event{AggregateID: fmt.Sprintf("aggregate-%d", i%6), Version: uint64(i/6 + 1)})
+	}
+
+	tests := []struct {
+		name     string
+		poolSize int
+	}{
+		{name: "no pool", poolSize: 0},
+		{name: "single worker", poolSize: 1},
+		{name: "pool of four", poolSize: 4},
+		{name: "pool larger than aggregates", poolSize: 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			seen := make(map[string][]uint64)
+			handlerPartitions := make(map[string]int)
+			calls := 0
+
+			handler := PartitionByAggregate(tt.poolSize, func(ctx context.Context, batch []Event) error {
+				mu.Lock()
+				defer mu.Unlock()
+				calls++
+				for _, event := range batch {
+					if call, ok := handlerPartitions[event.GetAggregateID()]; ok && call != calls {
+						return errors.Errorf("aggregate %s split between handler calls", event.GetAggregateID())
+					}
+					handlerPartitions[event.GetAggregateID()] = calls
+					seen[event.GetAggregateID()] = append(seen[event.GetAggregateID()], event.GetVersion())
+				}
+				return nil
+			})
+
+			if err := handler(context.Background(), events); err != nil {
+				t.Fatal(err)
+			}
+			if len(seen) != 6 {
+				t.Fatalf("handled %d aggregates, want 6", len(seen))
+			}
+			for aggregateID, versions := range seen {
+				for i, version := range versions {
+					if version != uint64(i+1) {
+						t.Fatalf("aggregate %s versions %v not in order", aggregateID, versions)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPartitionByAggregateError(t *testing.T) {
+	errHandler := errors.New("handler")
+	handler := PartitionByAggregate(4, func(ctx context.Context, batch []Event) error {
+		return errHandler
+	})
+
+	if err := handler(context.Background(), []Event{{AggregateID: "a"}, {AggregateID: "b"}}); !errors.Is(err, errHandler) {
+		t.Fatalf("err = %v, want %v", err, errHandler)
+	}
+}
+
+func TestAggregatePartition(t *testing.T) {
+	tests := []struct {
+		aggregateID string
+		poolSize    int
+	}{
+		{aggregateID: "", poolSize: 1},
+		{aggregateID: "a", poolSize: 2},
+		{aggregateID: "order-42", poolSize: 8},
+		{aggregateID: "0b9ad7f4-9d3b-4f6e-a1f2-6c7a0c5c1e11", poolSize: 3},
+	}
+
+	for _, tt := range tests {
+		idx := aggregatePartition(tt.aggregateID, tt.poolSize)
+		if idx < 0 || idx >= tt.poolSize {
+			t.Errorf("aggregatePartition(%q, %d) = %d out of range", tt.aggregateID, tt.poolSize, idx)
+		}
+		if again := aggregatePartition(tt.aggregateID, tt.poolSize); again != idx {
+			t.Errorf("aggregatePartition(%q, %d) not stable: %d != %d", tt.aggregateID, tt.poolSize, idx, again)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package es
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
+)
+
+// TypeRegistrySerializer default Serializer, maps registered event structs to EventType and back,
+// event data is serialized with serializer package codec, json by default.
+type TypeRegistrySerializer struct {
+	mu         sync.RWMutex
+	types      map[EventType]reflect.Type
+	eventTypes map[reflect.Type]EventType
+	codec      serializer.Codec
+}
+
+// NewTypeRegistrySerializer TypeRegistrySerializer constructor.
+func NewTypeRegistrySerializer() *TypeRegistrySerializer {
+	return &TypeRegistrySerializer{
+		types:      make(map[EventType]reflect.Type),
+		eventTypes: make(map[reflect.Type]EventType),
+		codec:      serializer.JSONCodec{},
+	}
+}
+
+// WithCodec set codec of new events, loaded events are decoded with codec recorded in their metadata.
+func (s *TypeRegistrySerializer) WithCodec(codec serializer.Codec) *TypeRegistrySerializer {
+	s.codec = codec
+	return s
+}
+
+// Register add event struct T with given EventType to the serializer, T and *T are both accepted by SerializeEvent,
+// DeserializeEvent returns *T.
+// Example:
+//
+//	s := es.NewTypeRegistrySerializer()
+//	es.Register[events.OrderCreated](s, events.OrderCreatedType)
+func Register[T any](s *TypeRegistrySerializer, eventType EventType) *TypeRegistrySerializer {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.types[eventType] = t
+	s.eventTypes[t] = eventType
+	s.eventTypes[reflect.PtrTo(t)] = eventType
+	return s
+}
+
+// EventType get registered EventType of the event struct.
+func (s *TypeRegistrySerializer) EventType(event any) (EventType, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	eventType, ok := s.eventTypes[reflect.TypeOf(event)]
+	if !ok {
+		return "", errors.Wrapf(ErrInvalidEventType, "type: %T is not registered", event)
+	}
+	return eventType, nil
+}
+
+// SerializeEvent marshal registered event struct to the Event of the aggregate.
+func (s *TypeRegistrySerializer) SerializeEvent(aggregate Aggregate, event any) (Event, error) {
+	eventType, err := s.EventType(event)
+	if err != nil {
+		return Event{}, err
+	}
+
+	esEvent := NewBaseEvent(aggregate, eventType)
+	if err := esEvent.EncodeData(event, s.codec); err != nil {
+		return Event{}, errors.Wrapf(err, "EncodeData eventType: %s, contentType: %s", eventType, s.codec.ContentType())
+	}
+
+	return esEvent, nil
+}
+
+// DeserializeEvent unmarshal Event data to the new instance of registered event struct.
+func (s *TypeRegistrySerializer) DeserializeEvent(event Event) (any, error) {
+	s.mu.RLock()
+	t, ok := s.types[event.GetEventType()]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, errors.Wrapf(ErrInvalidEventType, "eventType: %s, aggregateType: %s, aggregateID: %s, version: %d is not registered",
+			event.GetEventType(),
+			event.GetAggregateType(),
+			event.GetAggregateID(),
+			event.GetVersion(),
+		)
+	}
+
+	value := reflect.New(t).Interface()
+	if err := event.DecodeData(value); err != nil {
+		return nil, errors.Wrapf(err, "DecodeData eventType: %s, contentType: %s", event.GetEventType(), event.GetContentType())
+	}
+
+	return value, nil
+}
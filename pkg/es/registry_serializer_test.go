@@ -0,0 +1,110 @@
+package es
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
+)
+
+const testAggregateType AggregateType = "test"
+
+type testAggregate struct {
+	*AggregateBase
+	Name string `json:"name" msgpack:"name"`
+}
+
+func newTestAggregate(id string) *testAggregate {
+	aggregate := &testAggregate{}
+	aggregate.AggregateBase = NewAggregateBase(aggregate.When)
+	aggregate.SetType(testAggregateType)
+	aggregate.SetID(id)
+	return aggregate
+}
+
+func (a *testAggregate) When(event any) error {
+	if created, ok := event.(*testCreated); ok {
+		a.Name = created.Name
+	}
+	return nil
+}
+
+type testCreated struct {
+	Name string `json:"name" msgpack:"name"`
+}
+
+type testRenamed struct {
+	Name string `json:"name" msgpack:"name"`
+}
+
+func TestTypeRegistrySerializerRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec serializer.Codec
+		event any
+		want  any
+	}{
+		{name: "json value", codec: serializer.JSONCodec{}, event: testCreated{Name: "a"}, want: &testCreated{Name: "a"}},
+		{name: "json pointer", codec: serializer.JSONCodec{}, event: &testRenamed{Name: "b"}, want: &testRenamed{Name: "b"}},
+		{name: "msgpack", codec: serializer.MsgPackCodec{}, event: &testCreated{Name: "c"}, want: &testCreated{Name: "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewTypeRegistrySerializer().WithCodec(tt.codec)
+			Register[testCreated](s, "created")
+			Register[*testRenamed](s, "renamed")
+
+			event, err := s.SerializeEvent(newTestAggregate("1"), tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.GetContentType() != tt.codec.ContentType() {
+				t.Fatalf("content type = %s, want %s", event.GetContentType(), tt.codec.ContentType())
+			}
+			if event.GetAggregateID() != "1" || event.GetAggregateType() != testAggregateType {
+				t.Fatalf("aggregate = %s/%s, want 1/%s", event.GetAggregateType(), event.GetAggregateID(), testAggregateType)
+			}
+
+			got, err := s.DeserializeEvent(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("DeserializeEvent() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTypeRegistrySerializerNotRegistered(t *testing.T) {
+	s := NewTypeRegistrySerializer()
+	Register[testCreated](s, "created")
+
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{name: "serialize", run: func() error {
+			_, err := s.SerializeEvent(newTestAggregate("1"), testRenamed{})
+			return err
+		}},
+		{name: "deserialize", run: func() error {
+			_, err := s.DeserializeEvent(Event{EventType: "renamed"})
+			return err
+		}},
+		{name: "event type", run: func() error {
+			_, err := s.EventType(&testRenamed{})
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.run(); !errors.Is(err, ErrInvalidEventType) {
+				t.Fatalf("err = %v, want %v", err, ErrInvalidEventType)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package es
+
+import (
+	"context"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+	uuid "github.com/satori/go.uuid"
+)
+
+// SagaStatus lifecycle status of the saga instance.
+type SagaStatus string
+
+const (
+	SagaRunning     SagaStatus = "running"
+	SagaCompleted   SagaStatus = "completed"
+	SagaCompensated SagaStatus = "compensated"
+)
+
+// ErrSagaNotFound saga instance with given correlation key does not exist.
+var ErrSagaNotFound = errors.New("Saga not found")
+
+// CommandDispatcher dispatch commands emitted by sagas, implemented by CommandBus.
+type CommandDispatcher interface {
+	Dispatch(ctx context.Context, command Command) error
+}
+
+// Saga long running process coordinating several aggregates by reacting to their events with commands.
+type Saga interface {
+	// SagaType unique name of the saga.
+	SagaType() string
+
+	// StartedBy event types starting new saga instance.
+	StartedBy() []EventType
+
+	// ContinuedBy event types handled by already started saga instance.
+	ContinuedBy() []EventType
+
+	// Correlate return key of the saga instance the event belongs to, empty key ignores the event.
+	Correlate(event Event) string
+
+	// NewState return pointer to empty saga state, state is stored as json.
+	NewState() any
+
+	// Handle react to the event, change sc.State, emit commands, record completed steps, complete or fail the saga.
+	Handle(ctx context.Context, sc *SagaContext, event Event) error
+
+	// Compensate emit commands undoing the completed step, called in reverse order of steps after saga failed.
+	Compensate(ctx context.Context, sc *SagaContext, step string) error
+}
+
+// CorrelateByCorrelationID correlate events by correlation id metadata, so saga follows one business flow.
+func CorrelateByCorrelationID(event Event) string {
+	return event.GetCorrelationID()
+}
+
+// CorrelateByAggregateID correlate events by id of their aggregate.
+func CorrelateByAggregateID(event Event) string {
+	return event.GetAggregateID()
+}
+
+// SagaContext saga instance handled by Saga, commands are dispatched after Handle returned.
+type SagaContext struct {
+	SagaID         string
+	SagaType       string
+	CorrelationKey string
+	Status         SagaStatus
+	// State pointer created by Saga.NewState with loaded saga state.
+	State any
+
+	steps         []string
+	commands      []Command
+	failed        bool
+	failureReason string
+}
+
+// Dispatch emit commands dispatched with CommandDispatcher before the saga state is saved.
+func (sc *SagaContext) Dispatch(commands ...Command) {
+	sc.commands = append(sc.commands, commands...)
+}
+
+// StepCompleted record completed step which is compensated if the saga fails later.
+func (sc *SagaContext) StepCompleted(step string) {
+	sc.steps = append(sc.steps, step)
+}
+
+// Steps completed steps in order.
+func (sc *SagaContext) Steps() []string {
+	return sc.steps
+}
+
+// Complete finish the saga, later events of the instance are ignored.
+func (sc *SagaContext) Complete() {
+	sc.Status = SagaCompleted
+}
+
+// Fail compensate completed steps in reverse order and finish the saga as compensated.
+func (sc *SagaContext) Fail(reason string) {
+	sc.failed = true
+	sc.failureReason = reason
+}
+
+// SagaManager drive registered sagas with events and persist their state with SagaStore.
+// It implements Projection, so it is run by ProjectionRunner with Kafka or event store source.
+// Commands are dispatched before the state is saved, so a retried event can dispatch them again
+// and command handlers should be idempotent.
+type SagaManager struct {
+	log        logger.Logger
+	store      SagaStore
+	dispatcher CommandDispatcher
+
+	mu    sync.RWMutex
+	sagas map[EventType][]Saga
+}
+
+// NewSagaManager SagaManager constructor.
+func NewSagaManager(log logger.Logger, store SagaStore, dispatcher CommandDispatcher) *SagaManager {
+	return &SagaManager{
+		log:        log,
+		store:      store,
+		dispatcher: dispatcher,
+		sagas:      make(map[EventType][]Saga),
+	}
+}
+
+// RegisterSaga register saga for its start and continue event types.
+func (m *SagaManager) RegisterSaga(saga Saga) *SagaManager {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	registered := make(map[EventType]bool)
+	for _, eventTypes := range [][]EventType{saga.StartedBy(), saga.ContinuedBy()} {
+		for _, eventType := range eventTypes {
+			if registered[eventType] {
+				continue
+			}
+			registered[eventType] = true
+			m.sagas[eventType] = append(m.sagas[eventType], saga)
+		}
+	}
+	return m
+}
+
+// When handle the event by every saga registered for its type.
+func (m *SagaManager) When(ctx context.Context, event Event) error {
+	m.mu.RLock()
+	sagas := m.sagas[event.GetEventType()]
+	m.mu.RUnlock()
+
+	for _, saga := range sagas {
+		if err := m.handle(ctx, saga, event); err != nil {
+			return errors.Wrapf(err, "sagaType: %s", saga.SagaType())
+		}
+	}
+
+	return nil
+}
+
+func (m *SagaManager) handle(ctx context.Context, saga Saga, event Event) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "SagaManager.handle")
+	defer span.Finish()
+	span.LogFields(log.String("sagaType", saga.SagaType()), log.String("eventType", string(event.GetEventType())), log.String("eventID", event.GetEventID()))
+
+	correlationKey := saga.Correlate(event)
+	if correlationKey == "" {
+		return nil
+	}
+
+	instance, err := m.store.GetSaga(ctx, saga.SagaType(), correlationKey)
+	if err != nil && !errors.Is(err, ErrSagaNotFound) {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "store.GetSaga"))
+	}
+
+	if instance == nil {
+		if !containsEventType(saga.StartedBy(), event.GetEventType()) {
+			m.log.Debugf("(SagaManager) sagaType: %s, correlationKey: %s not started, skipped event: %s", saga.SagaType(), correlationKey, event.GetEventType())
+			return nil
+		}
+		instance = &SagaInstance{
+			SagaID:         uuid.NewV4().String(),
+			SagaType:       saga.SagaType(),
+			CorrelationKey: correlationKey,
+			Status:         SagaRunning,
+		}
+	} else {
+		if instance.Status != SagaRunning || !containsEventType(saga.ContinuedBy(), event.GetEventType()) {
+			return nil
+		}
+
+		processed, err := m.store.IsEventProcessed(ctx, instance.SagaID, event.GetEventID())
+		if err != nil {
+			return tracing.TraceWithErr(span, errors.Wrap(err, "store.IsEventProcessed"))
+		}
+		if processed {
+			return nil
+		}
+	}
+
+	state := saga.NewState()
+	if len(instance.State) > 0 {
+		if err := serializer.Unmarshal(instance.State, state); err != nil {
+			return tracing.TraceWithErr(span, errors.Wrap(err, "serializer.Unmarshal"))
+		}
+	}
+
+	sc := &SagaContext{
+		SagaID:         instance.SagaID,
+		SagaType:       instance.SagaType,
+		CorrelationKey: instance.CorrelationKey,
+		Status:         instance.Status,
+		State:          state,
+		steps:          append(make([]string, 0, len(instance.Steps)), instance.Steps...),
+	}
+
+	// commands keep correlation of the flow and are caused by the event
+	ctx = ContextFromEvent(ctx, event)
+
+	if err := saga.Handle(ctx, sc, event); err != nil {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "saga.Handle"))
+	}
+
+	if sc.failed {
+		if err := m.compensate(ctx, saga, sc); err != nil {
+			return tracing.TraceWithErr(span, err)
+		}
+	}
+
+	for _, command := range sc.commands {
+		if err := m.dispatcher.Dispatch(ctx, command); err != nil {
+			m.log.Errorf("(SagaManager) dispatcher.Dispatch sagaID: %s, command: %s, err: %v", sc.SagaID, CommandName(command), err)
+			return tracing.TraceWithErr(span, errors.Wrapf(err, "dispatcher.Dispatch command: %s", CommandName(command)))
+		}
+	}
+
+	if instance.State, err = serializer.Marshal(sc.State); err != nil {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "serializer.Marshal"))
+	}
+	instance.Status = sc.Status
+	instance.Steps = sc.steps
+	instance.FailureReason = sc.failureReason
+
+	if err := m.store.SaveSaga(ctx, instance, event.GetEventID()); err != nil {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "store.SaveSaga"))
+	}
+
+	m.log.Debugf("(SagaManager) sagaType: %s, sagaID: %s, eventType: %s, status: %s, commands: %d", instance.SagaType, instance.SagaID, event.GetEventType(), instance.Status, len(sc.commands))
+	return nil
+}
+
+// compensate completed steps in reverse order, compensating commands are dispatched after commands emitted by Handle.
+func (m *SagaManager) compensate(ctx context.Context, saga Saga, sc *SagaContext) error {
+	m.log.Infof("(SagaManager) compensating sagaType: %s, sagaID: %s, steps: %v, reason: %s", sc.SagaType, sc.SagaID, sc.steps, sc.failureReason)
+
+	for i := len(sc.steps) - 1; i >= 0; i-- {
+		if err := saga.Compensate(ctx, sc, sc.steps[i]); err != nil {
+			return errors.Wrapf(err, "saga.Compensate step: %s", sc.steps[i])
+		}
+	}
+
+	sc.Status = SagaCompensated
+	return nil
+}
+
+func containsEventType(eventTypes []EventType, eventType EventType) bool {
+	for _, t := range eventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
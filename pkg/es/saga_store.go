@@ -0,0 +1,141 @@
+package es
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+// SagaInstance persisted state of one saga instance.
+type SagaInstance struct {
+	SagaID         string
+	SagaType       string
+	CorrelationKey string
+	Status         SagaStatus
+	// State json of the saga state created by Saga.NewState.
+	State []byte
+	// Steps completed steps in order, compensated in reverse order.
+	Steps         []string
+	FailureReason string
+	Version       uint64
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// SagaStore is responsible for persisting saga instances.
+type SagaStore interface {
+	// GetSaga load saga instance by type and correlation key, returns ErrSagaNotFound if it does not exist.
+	GetSaga(ctx context.Context, sagaType string, correlationKey string) (*SagaInstance, error)
+
+	// IsEventProcessed check if the event was already handled by saga instance.
+	IsEventProcessed(ctx context.Context, sagaID string, eventID string) (bool, error)
+
+	// SaveSaga create or update saga instance together with handled event id, instance Version is incremented,
+	// returns ErrConcurrencyConflict if instance was changed or the event was handled concurrently.
+	SaveSaga(ctx context.Context, instance *SagaInstance, eventID string) error
+}
+
+type pgSagaStore struct {
+	log logger.Logger
+	db  *pgxpool.Pool
+}
+
+// NewPgSagaStore postgres SagaStore constructor, instances are stored in microservices.sagas.
+func NewPgSagaStore(log logger.Logger, db *pgxpool.Pool) *pgSagaStore {
+	return &pgSagaStore{log: log, db: db}
+}
+
+// GetSaga load saga instance from microservices.sagas
+func (s *pgSagaStore) GetSaga(ctx context.Context, sagaType string, correlationKey string) (*SagaInstance, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgSagaStore.GetSaga")
+	defer span.Finish()
+	span.LogFields(log.String("sagaType", sagaType), log.String("correlationKey", correlationKey))
+
+	var instance SagaInstance
+	if err := s.db.QueryRow(ctx, getSagaQuery, sagaType, correlationKey).Scan(
+		&instance.SagaID,
+		&instance.SagaType,
+		&instance.CorrelationKey,
+		&instance.Status,
+		&instance.State,
+		&instance.Steps,
+		&instance.FailureReason,
+		&instance.Version,
+		&instance.CreatedAt,
+		&instance.UpdatedAt,
+	); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errors.Wrapf(ErrSagaNotFound, "sagaType: %s, correlationKey: %s", sagaType, correlationKey)
+		}
+		s.log.Errorf("(GetSaga) db.QueryRow err: %v", err)
+		return nil, tracing.TraceWithErr(span, errors.Wrap(err, "db.QueryRow"))
+	}
+
+	return &instance, nil
+}
+
+// IsEventProcessed check microservices.saga_events for handled event
+func (s *pgSagaStore) IsEventProcessed(ctx context.Context, sagaID string, eventID string) (bool, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgSagaStore.IsEventProcessed")
+	defer span.Finish()
+	span.LogFields(log.String("sagaID", sagaID), log.String("eventID", eventID))
+
+	var processed bool
+	if err := s.db.QueryRow(ctx, isSagaEventProcessedQuery, sagaID, eventID).Scan(&processed); err != nil {
+		s.log.Errorf("(IsEventProcessed) db.QueryRow err: %v", err)
+		return false, tracing.TraceWithErr(span, errors.Wrap(err, "db.QueryRow"))
+	}
+
+	return processed, nil
+}
+
+// SaveSaga insert new or update existing saga instance with optimistic concurrency by version
+func (s *pgSagaStore) SaveSaga(ctx context.Context, instance *SagaInstance, eventID string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgSagaStore.SaveSaga")
+	defer span.Finish()
+	span.LogFields(log.String("sagaID", instance.SagaID), log.String("status", string(instance.Status)), log.Uint64("version", instance.Version))
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		s.log.Errorf("(SaveSaga) db.Begin err: %v", err)
+		return tracing.TraceWithErr(span, errors.Wrap(err, "db.Begin"))
+	}
+
+	version := instance.Version + 1
+	query, args := updateSagaQuery, []interface{}{instance.SagaID, instance.Status, instance.State, instance.Steps, instance.FailureReason, version, instance.Version}
+	if instance.Version == 0 {
+		query, args = createSagaQuery, []interface{}{instance.SagaID, instance.SagaType, instance.CorrelationKey, instance.Status, instance.State, instance.Steps, instance.FailureReason, version}
+	}
+
+	result, err := tx.Exec(ctx, query, args...)
+	if err != nil {
+		s.log.Errorf("(SaveSaga) tx.Exec err: %v", err)
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, errors.Wrap(err, "tx.Exec")))
+	}
+	if result.RowsAffected() == 0 {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, errors.Wrapf(ErrConcurrencyConflict, "sagaType: %s, correlationKey: %s, version: %d", instance.SagaType, instance.CorrelationKey, instance.Version)))
+	}
+
+	if eventID != "" {
+		if _, err := tx.Exec(ctx, saveSagaEventQuery, instance.SagaID, eventID); err != nil {
+			if isUniqueViolation(err) {
+				err = errors.Wrapf(newConcurrencyConflictError(err), "sagaID: %s, eventID: %s already processed", instance.SagaID, eventID)
+			}
+			return RollBackTx(ctx, tx, tracing.TraceWithErr(span, errors.Wrap(err, "tx.Exec")))
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "tx.Commit"))
+	}
+
+	instance.Version = version
+	return nil
+}
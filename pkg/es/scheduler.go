@@ -0,0 +1,332 @@
+package es
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	defaultSchedulerBatchSize      = 100
+	defaultSchedulerPollInterval   = 1 * time.Second
+	defaultSchedulerLockTimeout    = 1 * time.Minute
+	defaultSchedulerMaxAttempts    = 10
+	defaultSchedulerInitialBackoff = 1 * time.Second
+	defaultSchedulerMaxBackoff     = 5 * time.Minute
+)
+
+var (
+	// ErrInvalidScheduledEntry scheduled entry has no key or type.
+	ErrInvalidScheduledEntry = errors.New("Invalid scheduled entry")
+	// ErrScheduledHandlerNotFound no handler is registered for the scheduled entry type.
+	ErrScheduledHandlerNotFound = errors.New("Scheduled handler not found")
+)
+
+// SchedulerConfig durable scheduler config
+type SchedulerConfig struct {
+	BatchSize    int           `mapstructure:"batchSize" validate:"gte=0"`
+	PollInterval time.Duration `mapstructure:"pollInterval"`
+	// LockTimeout time the claiming replica owns the claimed batch, handlers are cancelled and not fired entries released when it passes.
+	LockTimeout time.Duration `mapstructure:"lockTimeout"`
+	// MaxAttempts failed entry is kept with failed_at and not fired anymore after MaxAttempts.
+	MaxAttempts    int           `mapstructure:"maxAttempts" validate:"gte=0"`
+	InitialBackoff time.Duration `mapstructure:"initialBackoff"`
+	MaxBackoff     time.Duration `mapstructure:"maxBackoff"`
+}
+
+// ScheduledEntry payload fired by Scheduler at DueAt, Key identifies entry for rescheduling and cancelling.
+type ScheduledEntry struct {
+	Key       string
+	Type      string
+	Payload   []byte
+	DueAt     time.Time
+	Attempts  int
+	CreatedAt time.Time
+
+	id int64
+}
+
+// ScheduledHandler handle due ScheduledEntry, returned error retry the entry with backoff.
+type ScheduledHandler func(ctx context.Context, entry ScheduledEntry) error
+
+// Scheduler durable timer stored in microservices.scheduled_entries.
+// Due entries are claimed with lock token for LockTimeout, so replicas never fire the same entry concurrently,
+// entry is deleted after handler succeeded, delivery is at-least-once if handler outlives LockTimeout or process crashes.
+type Scheduler struct {
+	log logger.Logger
+	cfg SchedulerConfig
+	db  *pgxpool.Pool
+
+	mu       sync.RWMutex
+	handlers map[string]ScheduledHandler
+}
+
+// NewScheduler Scheduler constructor.
+func NewScheduler(log logger.Logger, cfg SchedulerConfig, db *pgxpool.Pool) *Scheduler {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultSchedulerBatchSize
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultSchedulerPollInterval
+	}
+	if cfg.LockTimeout <= 0 {
+		cfg.LockTimeout = defaultSchedulerLockTimeout
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultSchedulerMaxAttempts
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = defaultSchedulerInitialBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultSchedulerMaxBackoff
+	}
+
+	return &Scheduler{
+		log:      log,
+		cfg:      cfg,
+		db:       db,
+		handlers: make(map[string]ScheduledHandler),
+	}
+}
+
+// RegisterHandler register handler of entries with given type, registering the same type twice replace the handler.
+func (s *Scheduler) RegisterHandler(entryType string, handler ScheduledHandler) *Scheduler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[entryType] = handler
+	return s
+}
+
+// RegisterScheduledCommand register handler dispatching command C stored by ScheduleCommand with given entry type.
+// Example:
+//
+//	es.RegisterScheduledCommand[*commands.EscalateRiskCommand](scheduler, "EscalateRisk", commandBus)
+func RegisterScheduledCommand[C Command](s *Scheduler, entryType string, dispatcher CommandDispatcher) *Scheduler {
+	commandType := reflect.TypeOf((*C)(nil)).Elem()
+
+	return s.RegisterHandler(entryType, func(ctx context.Context, entry ScheduledEntry) error {
+		var command C
+		target := any(&command)
+		if commandType.Kind() == reflect.Ptr {
+			command = reflect.New(commandType.Elem()).Interface().(C)
+			target = command
+		}
+
+		if err := serializer.Unmarshal(entry.Payload, target); err != nil {
+			return errors.Wrapf(err, "serializer.Unmarshal type: %s", commandType)
+		}
+		return dispatcher.Dispatch(ctx, command)
+	})
+}
+
+// Schedule store entry fired at entry.DueAt, existing entry with the same key is rescheduled.
+func (s *Scheduler) Schedule(ctx context.Context, entry ScheduledEntry) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Scheduler.Schedule")
+	defer span.Finish()
+	span.LogFields(log.String("key", entry.Key), log.String("type", entry.Type), log.String("dueAt", entry.DueAt.String()))
+
+	if entry.Key == "" || entry.Type == "" {
+		return tracing.TraceWithErr(span, errors.Wrapf(ErrInvalidScheduledEntry, "key: %s, type: %s", entry.Key, entry.Type))
+	}
+
+	if _, err := s.db.Exec(ctx, scheduleEntryQuery, entry.Key, entry.Type, entry.Payload, entry.DueAt.UTC()); err != nil {
+		s.log.Errorf("(Schedule) db.Exec err: %v", err)
+		return tracing.TraceWithErr(span, errors.Wrap(err, "db.Exec"))
+	}
+
+	s.log.Debugf("(Schedule) key: %s, type: %s, dueAt: %s", entry.Key, entry.Type, entry.DueAt)
+	return nil
+}
+
+// ScheduleCommand store command as json payload fired with handler registered by RegisterScheduledCommand.
+func (s *Scheduler) ScheduleCommand(ctx context.Context, key string, entryType string, command Command, dueAt time.Time) error {
+	payload, err := serializer.Marshal(command)
+	if err != nil {
+		return errors.Wrap(err, "serializer.Marshal")
+	}
+
+	return s.Schedule(ctx, ScheduledEntry{Key: key, Type: entryType, Payload: payload, DueAt: dueAt})
+}
+
+// Cancel delete entry by key, returns false if there was no such entry.
+func (s *Scheduler) Cancel(ctx context.Context, key string) (bool, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Scheduler.Cancel")
+	defer span.Finish()
+	span.LogFields(log.String("key", key))
+
+	result, err := s.db.Exec(ctx, cancelEntryQuery, key)
+	if err != nil {
+		s.log.Errorf("(Cancel) db.Exec err: %v", err)
+		return false, tracing.TraceWithErr(span, errors.Wrap(err, "db.Exec"))
+	}
+
+	return result.RowsAffected() > 0, nil
+}
+
+// Run fire due entries with configured interval until context is done.
+func (s *Scheduler) Run(ctx context.Context) error {
+	s.log.Infof("(Starting Scheduler) batchSize: %d, pollInterval: %s, lockTimeout: %s", s.cfg.BatchSize, s.cfg.PollInterval, s.cfg.LockTimeout)
+
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		fired, err := s.FireDue(ctx)
+		if err != nil {
+			s.log.Errorf("(Scheduler) FireDue err: %v", err)
+		}
+
+		// more entries are due, don't wait for next tick
+		if err == nil && fired == s.cfg.BatchSize {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			s.log.Infof("(Scheduler) stopped: %v", ctx.Err())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// FireDue claim one batch of due entries and fire them, returns count of claimed entries.
+func (s *Scheduler) FireDue(ctx context.Context) (int, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Scheduler.FireDue")
+	defer span.Finish()
+
+	lockToken := uuid.NewV4().String()
+	// local time before the claim, so the lease never ends later here than in the database
+	leaseDeadline := time.Now().Add(s.cfg.LockTimeout)
+	entries, err := s.claimDue(ctx, lockToken)
+	if err != nil {
+		return 0, tracing.TraceWithErr(span, err)
+	}
+
+	for i, entry := range entries {
+		if ctx.Err() != nil {
+			return len(entries), ctx.Err()
+		}
+		// the whole batch shares one lease, entries left after it passed may be claimed by another replica
+		if !time.Now().Before(leaseDeadline) {
+			s.release(ctx, lockToken, entries[i:])
+			break
+		}
+		if err := s.fire(ctx, lockToken, leaseDeadline, entry); err != nil {
+			s.log.Errorf("(Scheduler) fire key: %s, err: %v", entry.Key, err)
+		}
+	}
+
+	span.LogFields(log.Int("claimed", len(entries)))
+	return len(entries), nil
+}
+
+// release unlock not fired entries with restored attempts, entries claimed meanwhile by another replica are left untouched.
+func (s *Scheduler) release(ctx context.Context, lockToken string, entries []ScheduledEntry) {
+	ids := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.id)
+	}
+
+	if _, err := s.db.Exec(ctx, releaseEntriesQuery, ids, lockToken); err != nil {
+		s.log.Errorf("(Scheduler) release entries: %d, err: %v", len(ids), err)
+		return
+	}
+	s.log.Warnf("(Scheduler) lease passed, released entries: %d", len(ids))
+}
+
+func (s *Scheduler) claimDue(ctx context.Context, lockToken string) ([]ScheduledEntry, error) {
+	rows, err := s.db.Query(ctx, claimDueEntriesQuery, lockToken, s.cfg.LockTimeout.Milliseconds(), s.cfg.BatchSize)
+	if err != nil {
+		s.log.Errorf("(claimDue) db.Query err: %v", err)
+		return nil, errors.Wrap(err, "db.Query")
+	}
+	defer rows.Close()
+
+	entries := make([]ScheduledEntry, 0, s.cfg.BatchSize)
+	for rows.Next() {
+		var entry ScheduledEntry
+		if err := rows.Scan(&entry.id, &entry.Key, &entry.Type, &entry.Payload, &entry.DueAt, &entry.Attempts, &entry.CreatedAt); err != nil {
+			return nil, errors.Wrap(err, "rows.Scan")
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "rows.Err")
+	}
+
+	return entries, nil
+}
+
+// fire run entry handler until the lease deadline of its batch, entry is deleted on success or retried with backoff,
+// entry cancelled or rescheduled meanwhile has another lock token and is left untouched.
+func (s *Scheduler) fire(ctx context.Context, lockToken string, leaseDeadline time.Time, entry ScheduledEntry) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Scheduler.fire")
+	defer span.Finish()
+	span.LogFields(log.String("key", entry.Key), log.String("type", entry.Type), log.Int("attempts", entry.Attempts))
+
+	s.mu.RLock()
+	handler, ok := s.handlers[entry.Type]
+	s.mu.RUnlock()
+
+	var handlerErr error
+	if !ok {
+		handlerErr = errors.Wrapf(ErrScheduledHandlerNotFound, "type: %s", entry.Type)
+	} else {
+		handlerCtx, cancel := context.WithDeadline(ctx, leaseDeadline)
+		handlerErr = handler(handlerCtx, entry)
+		cancel()
+	}
+
+	if handlerErr == nil {
+		if _, err := s.db.Exec(ctx, completeEntryQuery, entry.id, lockToken); err != nil {
+			return tracing.TraceWithErr(span, errors.Wrap(err, "db.Exec"))
+		}
+		s.log.Debugf("(Scheduler) fired key: %s, type: %s, attempts: %d", entry.Key, entry.Type, entry.Attempts)
+		return nil
+	}
+
+	if entry.Attempts >= s.cfg.MaxAttempts {
+		s.log.Errorf("(Scheduler) key: %s failed after %d attempts, err: %v", entry.Key, entry.Attempts, handlerErr)
+		if _, err := s.db.Exec(ctx, failEntryQuery, entry.id, lockToken, handlerErr.Error()); err != nil {
+			return tracing.TraceWithErr(span, errors.Wrap(err, "db.Exec"))
+		}
+		return tracing.TraceWithErr(span, handlerErr)
+	}
+
+	s.log.Warnf("(Scheduler) key: %s, attempt: %d, err: %v", entry.Key, entry.Attempts, handlerErr)
+	dueAt := time.Now().UTC().Add(s.backoff(entry.Attempts - 1))
+	if _, err := s.db.Exec(ctx, retryEntryQuery, entry.id, lockToken, dueAt, handlerErr.Error()); err != nil {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "db.Exec"))
+	}
+	return nil
+}
+
+// backoff exponential backoff for given count of failed attempts limited with MaxBackoff.
+func (s *Scheduler) backoff(attempts int) time.Duration {
+	backoff := s.cfg.InitialBackoff
+	for i := 0; i < attempts && backoff < s.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > s.cfg.MaxBackoff {
+		return s.cfg.MaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,31 @@
+package es
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      SchedulerConfig
+		attempts int
+		want     time.Duration
+	}{
+		{name: "first retry", cfg: SchedulerConfig{InitialBackoff: time.Second, MaxBackoff: time.Minute}, attempts: 0, want: time.Second},
+		{name: "doubled", cfg: SchedulerConfig{InitialBackoff: time.Second, MaxBackoff: time.Minute}, attempts: 2, want: 4 * time.Second},
+		{name: "limited", cfg: SchedulerConfig{InitialBackoff: time.Second, MaxBackoff: time.Minute}, attempts: 6, want: time.Minute},
+		{name: "many attempts do not overflow", cfg: SchedulerConfig{InitialBackoff: time.Second, MaxBackoff: time.Minute}, attempts: 1000, want: time.Minute},
+		{name: "initial above max", cfg: SchedulerConfig{InitialBackoff: time.Hour, MaxBackoff: time.Minute}, attempts: 0, want: time.Minute},
+		{name: "defaults", cfg: SchedulerConfig{}, attempts: 1, want: 2 * defaultSchedulerInitialBackoff},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScheduler(nil, tt.cfg, nil)
+			if got := s.backoff(tt.attempts); got != tt.want {
+				t.Fatalf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package serializer
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgPack  = "application/x-msgpack"
+)
+
+var (
+	ErrUnknownContentType = errors.New("Unknown content type")
+	ErrNotProtoMessage    = errors.New("Value is not proto message")
+)
+
+// Codec encode and decode event payloads, ContentType is recorded with every event to select codec on load.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		ContentTypeJSON:     JSONCodec{},
+		ContentTypeProtobuf: ProtobufCodec{},
+		ContentTypeMsgPack:  MsgPackCodec{},
+	}
+)
+
+// RegisterCodec add custom codec or replace codec with the same content type.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[codec.ContentType()] = codec
+}
+
+// GetCodec get codec by content type, empty content type is JSON.
+func GetCodec(contentType string) (Codec, error) {
+	if contentType == "" {
+		return JSONCodec{}, nil
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	codec, ok := codecs[contentType]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownContentType, "contentType: %s", contentType)
+	}
+	return codec, nil
+}
+
+// JSONCodec json-iterator codec.
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return Unmarshal(data, v)
+}
+
+// ProtobufCodec protocol buffers codec, values must implement proto.Message,
+// Marshal also accepts value of the generated message struct registered as T instead of *T.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (ProtobufCodec) Marshal(v any) ([]byte, error) {
+	m, ok := asProtoMessage(v)
+	if !ok {
+		return nil, errors.Wrapf(ErrNotProtoMessage, "type: %T", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return errors.Wrapf(ErrNotProtoMessage, "type: %T", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// asProtoMessage return v as proto.Message, generated messages implement it on pointer receiver,
+// so the address of the copy is taken for the value.
+func asProtoMessage(v any) (proto.Message, bool) {
+	if m, ok := v.(proto.Message); ok {
+		return m, true
+	}
+
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || rv.Kind() == reflect.Ptr {
+		return nil, false
+	}
+
+	ptr := reflect.New(rv.Type())
+	ptr.Elem().Set(rv)
+	m, ok := ptr.Interface().(proto.Message)
+	return m, ok
+}
+
+// MsgPackCodec MessagePack codec.
+type MsgPackCodec struct{}
+
+func (MsgPackCodec) ContentType() string {
+	return ContentTypeMsgPack
+}
+
+func (MsgPackCodec) Marshal(v any) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (MsgPackCodec) Unmarshal(data []byte, v any) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,94 @@
+package serializer
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type codecPayload struct {
+	Name  string `json:"name" msgpack:"name"`
+	Count int    `json:"count" msgpack:"count"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+	}{
+		{name: "json", codec: JSONCodec{}},
+		{name: "msgpack", codec: MsgPackCodec{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.codec.Marshal(codecPayload{Name: "a", Count: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got codecPayload
+			if err := tt.codec.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != (codecPayload{Name: "a", Count: 2}) {
+				t.Fatalf("round trip = %+v", got)
+			}
+		})
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	codec := ProtobufCodec{}
+
+	data, err := codec.Marshal(wrapperspb.String("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := &wrapperspb.StringValue{}
+	if err := codec.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.GetValue() != "value" {
+		t.Fatalf("round trip = %q, want %q", got.GetValue(), "value")
+	}
+
+	if _, err := codec.Marshal(codecPayload{}); !errors.Is(err, ErrNotProtoMessage) {
+		t.Fatalf("Marshal err = %v, want %v", err, ErrNotProtoMessage)
+	}
+	if err := codec.Unmarshal(data, &codecPayload{}); !errors.Is(err, ErrNotProtoMessage) {
+		t.Fatalf("Unmarshal err = %v, want %v", err, ErrNotProtoMessage)
+	}
+}
+
+func TestGetCodec(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+		wantErr     bool
+	}{
+		{contentType: "", want: ContentTypeJSON},
+		{contentType: ContentTypeJSON, want: ContentTypeJSON},
+		{contentType: ContentTypeProtobuf, want: ContentTypeProtobuf},
+		{contentType: ContentTypeMsgPack, want: ContentTypeMsgPack},
+		{contentType: "text/plain", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		codec, err := GetCodec(tt.contentType)
+		if tt.wantErr {
+			if !errors.Is(err, ErrUnknownContentType) {
+				t.Errorf("GetCodec(%q) err = %v, want %v", tt.contentType, err, ErrUnknownContentType)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if codec.ContentType() != tt.want {
+			t.Errorf("GetCodec(%q) = %s, want %s", tt.contentType, codec.ContentType(), tt.want)
+		}
+	}
+}
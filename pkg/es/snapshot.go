@@ -2,6 +2,7 @@ package es
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
@@ -9,18 +10,36 @@ import (
 
 // Snapshot Event Sourcing Snapshoting is an optimisation that reduces time spent on reading event from an event store.
 type Snapshot struct {
-	ID      string        `json:"id"`
-	Type    AggregateType `json:"type"`
-	State   []byte        `json:"state"`
-	Version uint64        `json:"version"`
+	ID            string        `json:"id"`
+	Type          AggregateType `json:"type"`
+	State         []byte        `json:"state"`
+	Version       uint64        `json:"version"`
+	SchemaVersion uint32        `json:"schemaVersion"`
+	Timestamp     time.Time     `json:"timestamp"`
+}
+
+// SnapshotVersioned implemented by aggregates declaring schema version of their snapshot state,
+// it must be increased on each incompatible change of the aggregate struct.
+// Aggregates without it use schema version 1.
+type SnapshotVersioned interface {
+	SnapshotSchemaVersion() uint32
+}
+
+// SnapshotSchemaVersion schema version of the aggregate snapshot state.
+func SnapshotSchemaVersion(aggregate Aggregate) uint32 {
+	if versioned, ok := aggregate.(SnapshotVersioned); ok && versioned.SnapshotSchemaVersion() > 0 {
+		return versioned.SnapshotSchemaVersion()
+	}
+	return initialSchemaVersion
 }
 
 func (s *Snapshot) String() string {
-	return fmt.Sprintf("AggregateID: %s, AggregateType: %s, StateSize: %d, Version: %d",
+	return fmt.Sprintf("AggregateID: %s, AggregateType: %s, StateSize: %d, Version: %d, SchemaVersion: %d",
 		s.ID,
 		string(s.Type),
 		len(s.State),
 		s.Version,
+		s.SchemaVersion,
 	)
 }
 
@@ -32,10 +51,49 @@ func NewSnapshotFromAggregate(aggregate Aggregate) (*Snapshot, error) {
 	}
 
 	return &Snapshot{
-		ID:      aggregate.GetID(),
-		Type:    aggregate.GetType(),
-		State:   aggregateBytes,
-		Version: aggregate.GetVersion(),
+		ID:            aggregate.GetID(),
+		Type:          aggregate.GetType(),
+		State:         aggregateBytes,
+		Version:       aggregate.GetVersion(),
+		SchemaVersion: SnapshotSchemaVersion(aggregate),
 	}, nil
 
 }
+
+// SnapshotPurgeFilter select snapshots removed by PurgeSnapshots, empty fields match all snapshots,
+// at least one field must be set.
+type SnapshotPurgeFilter struct {
+	AggregateType AggregateType
+	// SchemaVersion purge snapshots with exactly this schema version.
+	SchemaVersion uint32
+	// BelowSchemaVersion purge snapshots older than this schema version.
+	BelowSchemaVersion uint32
+}
+
+func (f SnapshotPurgeFilter) isEmpty() bool {
+	return f.AggregateType == "" && f.SchemaVersion == 0 && f.BelowSchemaVersion == 0
+}
+
+func (f SnapshotPurgeFilter) aggregateType() *string {
+	if f.AggregateType == "" {
+		return nil
+	}
+	aggregateType := string(f.AggregateType)
+	return &aggregateType
+}
+
+func (f SnapshotPurgeFilter) schemaVersion() *int32 {
+	if f.SchemaVersion == 0 {
+		return nil
+	}
+	schemaVersion := int32(f.SchemaVersion)
+	return &schemaVersion
+}
+
+func (f SnapshotPurgeFilter) belowSchemaVersion() *int32 {
+	if f.BelowSchemaVersion == 0 {
+		return nil
+	}
+	schemaVersion := int32(f.BelowSchemaVersion)
+	return &schemaVersion
+}
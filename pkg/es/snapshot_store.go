@@ -3,9 +3,11 @@ package es
 import (
 	"context"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
 	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
 )
 
 // SaveSnapshot save es.Aggregate snapshot
@@ -19,9 +21,25 @@ func (p *pgEventStore) SaveSnapshot(ctx context.Context, aggregate Aggregate) er
 		return errors.Wrap(err, "NewSnapshotFromAggregate")
 	}
 
-	_, err = p.db.Exec(ctx, saveSnapshotQuery, snapshot.ID, snapshot.Type, snapshot.State, snapshot.Version)
+	return p.saveSnapshot(ctx, snapshot)
+}
+
+func (p *pgEventStore) saveSnapshot(ctx context.Context, snapshot *Snapshot) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.saveSnapshot")
+	defer span.Finish()
+
+	state, stateCompression, subjectID, err := p.encodeSnapshotState(ctx, snapshot)
+	if errors.Is(err, ErrSubjectForgotten) {
+		p.log.Debugf("(SaveSnapshot) skipped snapshot of forgotten subject, aggregateID: %s", snapshot.ID)
+		return nil
+	}
 	if err != nil {
-		return errors.Wrapf(err, "db.Exec")
+		return tracing.TraceWithErr(span, errors.Wrap(err, "encodeSnapshotState"))
+	}
+
+	_, err = p.db.Exec(ctx, saveSnapshotQuery, snapshot.ID, snapshot.Type, state, snapshot.Version, snapshot.SchemaVersion, string(stateCompression), subjectID)
+	if err != nil {
+		return tracing.TraceWithErr(span, errors.Wrapf(err, "db.Exec"))
 	}
 
 	p.log.Debugf("(SaveSnapshot) snapshot: %s", snapshot.String())
@@ -29,17 +47,176 @@ func (p *pgEventStore) SaveSnapshot(ctx context.Context, aggregate Aggregate) er
 	return nil
 }
 
-// GetSnapshot load es.Aggregate snapshot.
+// deferSnapshot queue snapshot for the background writer, full queue is handled by DeferredSnapshotConfig.FullQueuePolicy,
+// snapshot is written by the caller if the store was closed.
+func (p *pgEventStore) deferSnapshot(ctx context.Context, snapshot *Snapshot) {
+	p.deferredMu.RLock()
+	if p.deferredClosed {
+		p.deferredMu.RUnlock()
+		p.writeSnapshotNow(ctx, snapshot)
+		return
+	}
+
+	select {
+	case p.deferredSnapshots <- snapshot:
+		p.deferredMu.RUnlock()
+		return
+	default:
+	}
+
+	switch p.cfg.DeferredSnapshots.FullQueuePolicy {
+	case DeferredSnapshotBlock:
+		// Close waits for the lock, the writer keeps draining the queue meanwhile
+		select {
+		case p.deferredSnapshots <- snapshot:
+		case <-ctx.Done():
+			p.log.Warnf("(deferSnapshot) dropped snapshot aggregateID: %s, version: %d, err: %v", snapshot.ID, snapshot.Version, ctx.Err())
+		}
+		p.deferredMu.RUnlock()
+	case DeferredSnapshotWriteInline:
+		p.deferredMu.RUnlock()
+		p.writeSnapshotNow(ctx, snapshot)
+	default:
+		p.deferredMu.RUnlock()
+		p.log.Warnf("(deferSnapshot) queue is full, dropped snapshot aggregateID: %s, version: %d", snapshot.ID, snapshot.Version)
+	}
+}
+
+// writeSnapshotNow save deferred snapshot on the caller path, errors are only logged.
+func (p *pgEventStore) writeSnapshotNow(ctx context.Context, snapshot *Snapshot) {
+	if err := p.saveSnapshot(ctx, snapshot); err != nil {
+		p.log.Warnf("(deferSnapshot) saveSnapshot aggregateID: %s, err: %v", snapshot.ID, err)
+	}
+}
+
+// writeDeferredSnapshots save queued snapshots one by one until Close, saveSnapshotQuery never replaces newer snapshot with older one.
+func (p *pgEventStore) writeDeferredSnapshots() {
+	defer close(p.deferredDone)
+
+	for snapshot := range p.deferredSnapshots {
+		ctx, cancel := context.WithTimeout(context.Background(), deferredSnapshotTimeout)
+		if err := p.saveSnapshot(ctx, snapshot); err != nil {
+			p.log.Warnf("(writeDeferredSnapshots) saveSnapshot aggregateID: %s, err: %v", snapshot.ID, err)
+		}
+		cancel()
+	}
+}
+
+// GetSnapshot load es.Aggregate snapshot, returns ErrSubjectForgotten if the snapshot subject was forgotten.
 func (p *pgEventStore) GetSnapshot(ctx context.Context, id string) (*Snapshot, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.GetSnapshot")
 	defer span.Finish()
 	span.LogFields(log.String("AggregateID", id))
 
-	var snapshot Snapshot
-	if err := p.db.QueryRow(ctx, getSnapshotQuery, id).Scan(&snapshot.ID, &snapshot.Type, &snapshot.State, &snapshot.Version); err != nil {
+	snapshot, err := p.scanSnapshot(ctx, p.db.QueryRow(ctx, getSnapshotQuery, id))
+	if err != nil {
 		return nil, errors.Wrap(err, "db.QueryRow")
 	}
 
+	return snapshot, nil
+
+}
+
+// getSnapshotTx load last snapshot in transaction, nil if aggregate has no snapshot or its subject was forgotten.
+func (p *pgEventStore) getSnapshotTx(ctx context.Context, tx pgx.Tx, id string) (*Snapshot, error) {
+	snapshot, err := p.scanSnapshot(ctx, tx.QueryRow(ctx, getSnapshotQuery, id))
+	if err != nil {
+		if isSnapshotMissing(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "tx.QueryRow")
+	}
+
+	return snapshot, nil
+}
+
+// isSnapshotMissing aggregate has no snapshot or its subject was forgotten, aggregate is loaded by full replay.
+func isSnapshotMissing(err error) bool {
+	return errors.Is(err, pgx.ErrNoRows) || errors.Is(err, ErrSubjectForgotten)
+}
+
+// encodeSnapshotState compress and encrypt snapshot state, subjectID is empty if state is not encrypted.
+func (p *pgEventStore) encodeSnapshotState(ctx context.Context, snapshot *Snapshot) ([]byte, CompressionAlgorithm, string, error) {
+	state, stateCompression, err := p.cfg.Compression.compress(snapshot.State)
+	if err != nil {
+		return nil, "", "", errors.Wrap(err, "compress")
+	}
+
+	if p.shredder == nil {
+		return state, stateCompression, "", nil
+	}
+
+	state, subjectID, err := p.shredder.EncryptSnapshot(ctx, snapshot, state)
+	if err != nil {
+		return nil, "", "", errors.Wrap(err, "shredder.EncryptSnapshot")
+	}
+	return state, stateCompression, subjectID, nil
+}
+
+// scanSnapshot scan snapshot row, decrypt and decompress its state.
+func (p *pgEventStore) scanSnapshot(ctx context.Context, row pgx.Row) (*Snapshot, error) {
+	var snapshot Snapshot
+	var stateCompression, subjectID string
+	if err := row.Scan(&snapshot.ID, &snapshot.Type, &snapshot.State, &snapshot.Version, &snapshot.SchemaVersion, &stateCompression, &subjectID, &snapshot.Timestamp); err != nil {
+		return nil, err
+	}
+
+	if subjectID != "" {
+		if p.shredder == nil {
+			return nil, errors.Wrapf(ErrCryptoShredderNotConfigured, "aggregateID: %s, subjectID: %s", snapshot.ID, subjectID)
+		}
+		state, err := p.shredder.DecryptSnapshot(ctx, subjectID, snapshot.State)
+		if err != nil {
+			return nil, errors.Wrapf(err, "shredder.DecryptSnapshot aggregateID: %s", snapshot.ID)
+		}
+		snapshot.State = state
+	}
+
+	state, err := decompress(snapshot.State, CompressionAlgorithm(stateCompression))
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress")
+	}
+	snapshot.State = state
+
 	return &snapshot, nil
+}
+
+// PurgeSnapshots delete snapshots of aggregate type or schema version, aggregates are loaded by full replay until next snapshot.
+func (p *pgEventStore) PurgeSnapshots(ctx context.Context, filter SnapshotPurgeFilter) (int64, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.PurgeSnapshots")
+	defer span.Finish()
+	span.LogFields(log.String("AggregateType", string(filter.AggregateType)), log.Uint32("SchemaVersion", filter.SchemaVersion), log.Uint32("BelowSchemaVersion", filter.BelowSchemaVersion))
+
+	if filter.isEmpty() {
+		return 0, tracing.TraceWithErr(span, ErrEmptyPurgeFilter)
+	}
+
+	result, err := p.db.Exec(ctx, purgeSnapshotsQuery, filter.aggregateType(), filter.schemaVersion(), filter.belowSchemaVersion())
+	if err != nil {
+		p.log.Errorf("(PurgeSnapshots) db.Exec err: %v", err)
+		return 0, tracing.TraceWithErr(span, errors.Wrap(err, "db.Exec"))
+	}
+
+	p.log.Infof("(PurgeSnapshots) AggregateType: %s, SchemaVersion: %d, BelowSchemaVersion: %d, deleted: %d", filter.AggregateType, filter.SchemaVersion, filter.BelowSchemaVersion, result.RowsAffected())
+	return result.RowsAffected(), nil
+}
+
+// usableSnapshot return snapshot matching aggregate schema version, upcasting older one if possible, false if snapshot must be ignored.
+func (p *pgEventStore) usableSnapshot(aggregate Aggregate, snapshot *Snapshot) (*Snapshot, bool) {
+	targetVersion := SnapshotSchemaVersion(aggregate)
+	if snapshot.SchemaVersion == targetVersion {
+		return snapshot, true
+	}
+
+	upcasted, ok, err := p.snapshotUpcasters.Upcast(*snapshot, targetVersion)
+	if err != nil {
+		p.log.Warnf("(usableSnapshot) snapshotUpcasters.Upcast aggregateID: %s, err: %v", snapshot.ID, err)
+		return nil, false
+	}
+	if !ok {
+		p.log.Warnf("(usableSnapshot) ignore snapshot aggregateID: %s, schemaVersion: %d, expected: %d", snapshot.ID, snapshot.SchemaVersion, targetVersion)
+		return nil, false
+	}
 
+	return &upcasted, true
 }
@@ -0,0 +1,152 @@
+package es
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
+)
+
+// SnapshotMode when Save writes snapshot chosen by SnapshotStrategy.
+type SnapshotMode string
+
+const (
+	// SnapshotInline write snapshot in the save transaction.
+	SnapshotInline SnapshotMode = ""
+	// SnapshotDeferred hand snapshot to the background writer after save transaction is committed,
+	// Save does not wait for it and write errors are only logged, Close the store to flush queued snapshots on shutdown.
+	SnapshotDeferred SnapshotMode = "deferred"
+)
+
+// DeferredSnapshotFullQueuePolicy what Save does with deferred snapshot when the writer queue is full.
+type DeferredSnapshotFullQueuePolicy string
+
+const (
+	// DeferredSnapshotDrop drop the snapshot with warning, the strategy takes it again on later saves.
+	DeferredSnapshotDrop DeferredSnapshotFullQueuePolicy = ""
+	// DeferredSnapshotBlock wait for free queue slot or Save context done.
+	DeferredSnapshotBlock DeferredSnapshotFullQueuePolicy = "block"
+	// DeferredSnapshotWriteInline write the snapshot on the Save caller path after commit.
+	DeferredSnapshotWriteInline DeferredSnapshotFullQueuePolicy = "inline"
+)
+
+const defaultDeferredSnapshotQueueSize = 256
+
+// DeferredSnapshotConfig background writer of SnapshotDeferred snapshots, stopped with Close.
+type DeferredSnapshotConfig struct {
+	// QueueSize snapshots waiting for the writer, 256 if zero.
+	QueueSize       int                             `json:"queueSize"`
+	FullQueuePolicy DeferredSnapshotFullQueuePolicy `json:"fullQueuePolicy"`
+}
+
+func (c DeferredSnapshotConfig) queueSize() int {
+	if c.QueueSize > 0 {
+		return c.QueueSize
+	}
+	return defaultDeferredSnapshotQueueSize
+}
+
+// SnapshotContext saved aggregate information passed to SnapshotStrategy.
+type SnapshotContext struct {
+	Aggregate Aggregate
+	// PreviousVersion aggregate version before saved events.
+	PreviousVersion uint64
+	// CurrentVersion aggregate version after saved events.
+	CurrentVersion uint64
+	// LastSnapshot load last aggregate snapshot, nil if aggregate has no snapshot.
+	LastSnapshot func(ctx context.Context) (*Snapshot, error)
+}
+
+// SnapshotStrategy decide if Save should take aggregate snapshot.
+type SnapshotStrategy interface {
+	ShouldSnapshot(ctx context.Context, sc SnapshotContext) (bool, error)
+}
+
+// SnapshotStrategyFunc function adapter of SnapshotStrategy.
+type SnapshotStrategyFunc func(ctx context.Context, sc SnapshotContext) (bool, error)
+
+func (f SnapshotStrategyFunc) ShouldSnapshot(ctx context.Context, sc SnapshotContext) (bool, error) {
+	return f(ctx, sc)
+}
+
+// NeverSnapshot strategy which never takes snapshot.
+func NeverSnapshot() SnapshotStrategy {
+	return SnapshotStrategyFunc(func(ctx context.Context, sc SnapshotContext) (bool, error) {
+		return false, nil
+	})
+}
+
+// EveryNEvents take snapshot when saved events cross multiple of n, also for multi-event saves skipping the exact version.
+func EveryNEvents(n uint64) SnapshotStrategy {
+	return SnapshotStrategyFunc(func(ctx context.Context, sc SnapshotContext) (bool, error) {
+		if n == 0 {
+			return false, nil
+		}
+		return sc.PreviousVersion/n != sc.CurrentVersion/n, nil
+	})
+}
+
+// TimeSinceLastSnapshot take snapshot if last one is older than interval or aggregate has no snapshot yet.
+func TimeSinceLastSnapshot(interval time.Duration) SnapshotStrategy {
+	return SnapshotStrategyFunc(func(ctx context.Context, sc SnapshotContext) (bool, error) {
+		snapshot, err := sc.LastSnapshot(ctx)
+		if err != nil {
+			return false, errors.Wrap(err, "LastSnapshot")
+		}
+		if snapshot == nil {
+			return true, nil
+		}
+		return time.Since(snapshot.Timestamp) >= interval, nil
+	})
+}
+
+// StateSize take snapshot when serialized aggregate state reaches given size in bytes.
+func StateSize(bytes int) SnapshotStrategy {
+	return SnapshotStrategyFunc(func(ctx context.Context, sc SnapshotContext) (bool, error) {
+		state, err := serializer.Marshal(sc.Aggregate)
+		if err != nil {
+			return false, errors.Wrap(err, "serializer.Marshal")
+		}
+		return len(state) >= bytes, nil
+	})
+}
+
+// PerAggregateType choose strategy by AggregateType, defaultStrategy is used for other types.
+func PerAggregateType(strategies map[AggregateType]SnapshotStrategy, defaultStrategy SnapshotStrategy) SnapshotStrategy {
+	return SnapshotStrategyFunc(func(ctx context.Context, sc SnapshotContext) (bool, error) {
+		if strategy, ok := strategies[sc.Aggregate.GetType()]; ok {
+			return strategy.ShouldSnapshot(ctx, sc)
+		}
+		if defaultStrategy == nil {
+			return false, nil
+		}
+		return defaultStrategy.ShouldSnapshot(ctx, sc)
+	})
+}
+
+// AnyOf take snapshot when any of strategies decide so.
+func AnyOf(strategies ...SnapshotStrategy) SnapshotStrategy {
+	return SnapshotStrategyFunc(func(ctx context.Context, sc SnapshotContext) (bool, error) {
+		for _, strategy := range strategies {
+			ok, err := strategy.ShouldSnapshot(ctx, sc)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	})
+}
+
+// AllOf take snapshot when all strategies decide so.
+func AllOf(strategies ...SnapshotStrategy) SnapshotStrategy {
+	return SnapshotStrategyFunc(func(ctx context.Context, sc SnapshotContext) (bool, error) {
+		for _, strategy := range strategies {
+			ok, err := strategy.ShouldSnapshot(ctx, sc)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return len(strategies) > 0, nil
+	})
+}
@@ -0,0 +1,106 @@
+package es
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestEveryNEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		n        uint64
+		previous uint64
+		current  uint64
+		want     bool
+	}{
+		{name: "disabled", n: 0, previous: 0, current: 100},
+		{name: "below boundary", n: 10, previous: 3, current: 9},
+		{name: "reach boundary", n: 10, previous: 9, current: 10, want: true},
+		{name: "start at boundary", n: 10, previous: 10, current: 11},
+		{name: "skip boundary in multi-event save", n: 10, previous: 8, current: 13, want: true},
+		{name: "cross several boundaries", n: 10, previous: 5, current: 31, want: true},
+		{name: "first event", n: 1, previous: 0, current: 1, want: true},
+		{name: "no new events", n: 5, previous: 5, current: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EveryNEvents(tt.n).ShouldSnapshot(context.Background(), SnapshotContext{PreviousVersion: tt.previous, CurrentVersion: tt.current})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("EveryNEvents(%d) %d -> %d = %v, want %v", tt.n, tt.previous, tt.current, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeSinceLastSnapshot(t *testing.T) {
+	errLoad := errors.New("load")
+	lastSnapshot := func(snapshot *Snapshot, err error) func(ctx context.Context) (*Snapshot, error) {
+		return func(ctx context.Context) (*Snapshot, error) {
+			return snapshot, err
+		}
+	}
+
+	tests := []struct {
+		name         string
+		lastSnapshot func(ctx context.Context) (*Snapshot, error)
+		want         bool
+		wantErr      error
+	}{
+		{name: "no snapshot", lastSnapshot: lastSnapshot(nil, nil), want: true},
+		{name: "recent snapshot", lastSnapshot: lastSnapshot(&Snapshot{Timestamp: time.Now().Add(-time.Minute)}, nil)},
+		{name: "old snapshot", lastSnapshot: lastSnapshot(&Snapshot{Timestamp: time.Now().Add(-2 * time.Hour)}, nil), want: true},
+		{name: "load error", lastSnapshot: lastSnapshot(nil, errLoad), wantErr: errLoad},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := TimeSinceLastSnapshot(time.Hour).ShouldSnapshot(context.Background(), SnapshotContext{LastSnapshot: tt.lastSnapshot})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("ShouldSnapshot() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComposedSnapshotStrategies(t *testing.T) {
+	yes := SnapshotStrategyFunc(func(ctx context.Context, sc SnapshotContext) (bool, error) { return true, nil })
+	no := NeverSnapshot()
+
+	tests := []struct {
+		name     string
+		strategy SnapshotStrategy
+		want     bool
+	}{
+		{name: "any of none", strategy: AnyOf()},
+		{name: "any of one true", strategy: AnyOf(no, yes), want: true},
+		{name: "any of all false", strategy: AnyOf(no, no)},
+		{name: "all of none", strategy: AllOf()},
+		{name: "all of true", strategy: AllOf(yes, yes), want: true},
+		{name: "all of one false", strategy: AllOf(yes, no)},
+		{name: "per aggregate type match", strategy: PerAggregateType(map[AggregateType]SnapshotStrategy{testAggregateType: yes}, no), want: true},
+		{name: "per aggregate type default", strategy: PerAggregateType(map[AggregateType]SnapshotStrategy{"other": no}, yes), want: true},
+		{name: "per aggregate type no default", strategy: PerAggregateType(map[AggregateType]SnapshotStrategy{"other": yes}, nil)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.strategy.ShouldSnapshot(context.Background(), SnapshotContext{Aggregate: newTestAggregate("1")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("ShouldSnapshot() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package es
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SnapshotUpcastFunc transform Snapshot state from registered schema version to the next one.
+type SnapshotUpcastFunc func(snapshot Snapshot) (Snapshot, error)
+
+type snapshotUpcasterKey struct {
+	aggregateType AggregateType
+	schemaVersion uint32
+}
+
+// SnapshotUpcasterRegistry registry of snapshot upcasters keyed by AggregateType and schema version.
+type SnapshotUpcasterRegistry struct {
+	mu        sync.RWMutex
+	upcasters map[snapshotUpcasterKey]SnapshotUpcastFunc
+}
+
+// NewSnapshotUpcasterRegistry SnapshotUpcasterRegistry constructor.
+func NewSnapshotUpcasterRegistry() *SnapshotUpcasterRegistry {
+	return &SnapshotUpcasterRegistry{upcasters: make(map[snapshotUpcasterKey]SnapshotUpcastFunc)}
+}
+
+// Register add upcaster of AggregateType snapshots from given schema version to fromVersion+1.
+func (r *SnapshotUpcasterRegistry) Register(aggregateType AggregateType, fromVersion uint32, upcast SnapshotUpcastFunc) *SnapshotUpcasterRegistry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.upcasters[snapshotUpcasterKey{aggregateType: aggregateType, schemaVersion: fromVersion}] = upcast
+	return r
+}
+
+// Upcast apply chained upcasters until snapshot reaches target schema version,
+// returns false if there is no upcaster path to the target version.
+func (r *SnapshotUpcasterRegistry) Upcast(snapshot Snapshot, targetVersion uint32) (Snapshot, bool, error) {
+	if snapshot.SchemaVersion == 0 {
+		snapshot.SchemaVersion = initialSchemaVersion
+	}
+
+	for snapshot.SchemaVersion < targetVersion {
+		r.mu.RLock()
+		upcast, ok := r.upcasters[snapshotUpcasterKey{aggregateType: snapshot.Type, schemaVersion: snapshot.SchemaVersion}]
+		r.mu.RUnlock()
+		if !ok {
+			return snapshot, false, nil
+		}
+
+		fromVersion := snapshot.SchemaVersion
+		upcasted, err := upcast(snapshot)
+		if err != nil {
+			return snapshot, false, errors.Wrapf(err, "upcast aggregateType: %s, schemaVersion: %d", snapshot.Type, fromVersion)
+		}
+		if upcasted.SchemaVersion <= fromVersion {
+			upcasted.SchemaVersion = fromVersion + 1
+		}
+		snapshot = upcasted
+	}
+
+	return snapshot, snapshot.SchemaVersion == targetVersion, nil
+}
@@ -0,0 +1,57 @@
+package es
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestSnapshotUpcasterRegistryUpcast(t *testing.T) {
+	appendState := func(suffix string) SnapshotUpcastFunc {
+		return func(snapshot Snapshot) (Snapshot, error) {
+			snapshot.State = append(snapshot.State, suffix...)
+			return snapshot, nil
+		}
+	}
+
+	registry := NewSnapshotUpcasterRegistry().
+		Register(testAggregateType, 1, appendState("-v2")).
+		Register(testAggregateType, 2, appendState("-v3")).
+		Register("failing", 1, func(snapshot Snapshot) (Snapshot, error) { return snapshot, errors.New("broken") })
+
+	tests := []struct {
+		name          string
+		snapshot      Snapshot
+		targetVersion uint32
+		wantOK        bool
+		wantVersion   uint32
+		wantState     string
+		wantErr       bool
+	}{
+		{name: "chain to target", snapshot: Snapshot{Type: testAggregateType, SchemaVersion: 1, State: []byte("s")}, targetVersion: 3, wantOK: true, wantVersion: 3, wantState: "s-v2-v3"},
+		{name: "zero schema version is first version", snapshot: Snapshot{Type: testAggregateType, State: []byte("s")}, targetVersion: 2, wantOK: true, wantVersion: 2, wantState: "s-v2"},
+		{name: "already at target", snapshot: Snapshot{Type: testAggregateType, SchemaVersion: 3, State: []byte("s")}, targetVersion: 3, wantOK: true, wantVersion: 3, wantState: "s"},
+		{name: "missing step", snapshot: Snapshot{Type: testAggregateType, SchemaVersion: 1, State: []byte("s")}, targetVersion: 4, wantVersion: 3, wantState: "s-v2-v3"},
+		{name: "newer than target", snapshot: Snapshot{Type: testAggregateType, SchemaVersion: 5, State: []byte("s")}, targetVersion: 3, wantVersion: 5, wantState: "s"},
+		{name: "unknown aggregate type", snapshot: Snapshot{Type: "other", SchemaVersion: 1, State: []byte("s")}, targetVersion: 2, wantVersion: 1, wantState: "s"},
+		{name: "upcaster error", snapshot: Snapshot{Type: "failing", SchemaVersion: 1}, targetVersion: 2, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot, ok, err := registry.Upcast(tt.snapshot, tt.targetVersion)
+			if tt.wantErr {
+				if err == nil || ok {
+					t.Fatalf("Upcast() = %v, %v, want error", ok, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOK || snapshot.SchemaVersion != tt.wantVersion || string(snapshot.State) != tt.wantState {
+				t.Fatalf("Upcast() = v%d %q %v, want v%d %q %v", snapshot.SchemaVersion, snapshot.State, ok, tt.wantVersion, tt.wantState, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package es
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+const (
+	defaultSnapshotterName        = "snapshotter"
+	defaultSnapshotterThreshold   = 100
+	defaultSnapshotterConcurrency = 4
+)
+
+// SnapshotterConfig background snapshotter config
+type SnapshotterConfig struct {
+	Name string `mapstructure:"name"`
+	// Threshold count of events since the last snapshot after which aggregate snapshot is rebuilt.
+	Threshold    uint64        `mapstructure:"threshold" validate:"gte=0"`
+	Concurrency  int           `mapstructure:"concurrency" validate:"gte=0"`
+	BatchSize    int           `mapstructure:"batchSize" validate:"gte=0"`
+	PollInterval time.Duration `mapstructure:"pollInterval"`
+}
+
+// SnapshotterMetrics record rebuilt snapshots, implemented by the app specific metrics like prometheus.
+// replayLengthSaved is count of events the next Load does not have to replay.
+type SnapshotterMetrics interface {
+	ObserveSnapshot(aggregateType AggregateType, replayLengthSaved uint64, duration time.Duration, err error)
+}
+
+// Snapshotter rebuild aggregate snapshots off the hot path.
+// It follows the $all stream with persistent Subscription, watches stream length since the last snapshot
+// and when it reaches Threshold loads the aggregate created by registered factory and writes its snapshot.
+// Use it together with NeverSnapshot strategy to remove snapshots from Save transaction.
+type Snapshotter struct {
+	log             logger.Logger
+	cfg             SnapshotterConfig
+	store           AggregateStore
+	checkpointStore CheckpointStore
+	metrics         SnapshotterMetrics
+
+	mu        sync.RWMutex
+	factories map[AggregateType]func() Aggregate
+}
+
+// NewSnapshotter Snapshotter constructor, metrics may be nil.
+func NewSnapshotter(log logger.Logger, cfg SnapshotterConfig, store AggregateStore, checkpointStore CheckpointStore, metrics SnapshotterMetrics) *Snapshotter {
+	if cfg.Name == "" {
+		cfg.Name = defaultSnapshotterName
+	}
+	if cfg.Threshold == 0 {
+		cfg.Threshold = defaultSnapshotterThreshold
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = defaultSnapshotterConcurrency
+	}
+
+	return &Snapshotter{
+		log:             log,
+		cfg:             cfg,
+		store:           store,
+		checkpointStore: checkpointStore,
+		metrics:         metrics,
+		factories:       make(map[AggregateType]func() Aggregate),
+	}
+}
+
+// RegisterAggregate register factory of empty aggregate of given type, only registered types are snapshotted.
+func (s *Snapshotter) RegisterAggregate(aggregateType AggregateType, factory func() Aggregate) *Snapshotter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.factories[aggregateType] = factory
+	return s
+}
+
+// Run follow events of registered aggregate types and rebuild snapshots until context is done.
+func (s *Snapshotter) Run(ctx context.Context) error {
+	s.mu.RLock()
+	aggregateTypes := make([]AggregateType, 0, len(s.factories))
+	for aggregateType := range s.factories {
+		aggregateTypes = append(aggregateTypes, aggregateType)
+	}
+	s.mu.RUnlock()
+
+	if len(aggregateTypes) == 0 {
+		return errors.Wrap(ErrInvalidAggregate, "no aggregate factories registered")
+	}
+
+	subscription := NewSubscription(s.log, SubscriptionConfig{
+		Name:         s.cfg.Name,
+		BatchSize:    s.cfg.BatchSize,
+		PollInterval: s.cfg.PollInterval,
+		Filter:       ReadAllFilter{AggregateTypes: aggregateTypes},
+	}, s.store, s.checkpointStore, PartitionByAggregate(s.cfg.Concurrency, s.handleEvents))
+
+	return subscription.Run(ctx)
+}
+
+// handleEvents check each aggregate of the batch once at its last seen version,
+// failed snapshots are only logged because they will be retried on the next aggregate events.
+func (s *Snapshotter) handleEvents(ctx context.Context, events []Event) error {
+	lastEvents := make(map[string]Event, len(events))
+	for _, event := range events {
+		if event.IsStreamLifecycleEvent() {
+			continue
+		}
+		lastEvents[event.GetAggregateID()] = event
+	}
+
+	for _, event := range lastEvents {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := s.snapshotIfNeeded(ctx, event.GetAggregateType(), event.GetAggregateID(), event.GetVersion()); err != nil {
+			s.log.Warnf("(Snapshotter) snapshotIfNeeded aggregateID: %s, err: %v", event.GetAggregateID(), err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Snapshotter) snapshotIfNeeded(ctx context.Context, aggregateType AggregateType, aggregateID string, version uint64) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Snapshotter.snapshotIfNeeded")
+	defer span.Finish()
+	span.LogFields(log.String("AggregateID", aggregateID), log.Uint64("Version", version))
+
+	s.mu.RLock()
+	factory, ok := s.factories[aggregateType]
+	s.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	var snapshotVersion uint64
+	snapshot, err := s.store.GetSnapshot(ctx, aggregateID)
+	if err != nil && !isSnapshotMissing(err) {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "store.GetSnapshot"))
+	}
+	// snapshot of another schema version is ignored by Load, so it is rebuilt like a missing one
+	if snapshot != nil && snapshot.SchemaVersion == SnapshotSchemaVersion(factory()) {
+		snapshotVersion = snapshot.Version
+	}
+
+	if version < snapshotVersion || version-snapshotVersion < s.cfg.Threshold {
+		return nil
+	}
+
+	start := time.Now()
+	replayLengthSaved, err := s.rebuildSnapshot(ctx, factory, aggregateID, snapshotVersion)
+	if s.metrics != nil {
+		s.metrics.ObserveSnapshot(aggregateType, replayLengthSaved, time.Since(start), err)
+	}
+	if err != nil {
+		return tracing.TraceWithErr(span, err)
+	}
+
+	s.log.Debugf("(Snapshotter) aggregateID: %s, aggregateType: %s, replayLengthSaved: %d, time: %s", aggregateID, aggregateType, replayLengthSaved, time.Since(start))
+	return nil
+}
+
+func (s *Snapshotter) rebuildSnapshot(ctx context.Context, factory func() Aggregate, aggregateID string, snapshotVersion uint64) (uint64, error) {
+	aggregate := factory()
+	aggregate.SetID(aggregateID)
+
+	if err := s.store.Load(ctx, aggregate); err != nil {
+		return 0, errors.Wrap(err, "store.Load")
+	}
+
+	aggregate.ToSnapshot()
+	if err := s.store.SaveSnapshot(ctx, aggregate); err != nil {
+		return 0, errors.Wrap(err, "store.SaveSnapshot")
+	}
+
+	return aggregate.GetVersion() - snapshotVersion, nil
+}
@@ -1,24 +1,178 @@
 package es
 
 const (
-	saveEventQuery = `INSERT INTO microservices.events as e (aggregate_id, aggregate_type, event_type, data, version, metadata, timestamp)
-	VALUES ($1, $2, $3, $4, $5, $6, now())`
+	saveEventQuery = `INSERT INTO microservices.events as e (aggregate_id, aggregate_type, event_type, data, version, metadata, timestamp, schema_version, data_compression, event_id)
+	VALUES ($1, $2, $3, $4, $5, $6, now(), $7, $8, $9)`
 
-	getEventsQuery = `SELECT event_id, aggregate_id, aggregate_type, event_type, data, version, timestamp, metadata
+	getEventsQuery = `SELECT event_id, aggregate_id, aggregate_type, event_type, data, version, timestamp, metadata, schema_version, data_compression
 	FROM microservices.events e WHERE aggregate_id = $1 ORDER BY version ASC`
 
-	// need checked after
-	getEventQuery = `SELECT aggregate_id FROM micreservices.events e WHERE aggregate_id = $1`
+	getEventQuery = `SELECT aggregate_id FROM microservices.events e WHERE aggregate_id = $1
+	AND NOT EXISTS (SELECT 1 FROM microservices.streams s WHERE s.aggregate_id = e.aggregate_id AND s.state IN ('soft_deleted', 'hard_deleted')) LIMIT 1`
 
-	getEventsByVersionQuery = `SELECT event_id, aggregate_id, aggregate_type, event_type, data, version, timestamp, metadata
+	getEventsByVersionQuery = `SELECT event_id, aggregate_id, aggregate_type, event_type, data, version, timestamp, metadata, schema_version, data_compression
 	FROM microservices.events e WHERE aggregate_id = $1 AND version > $2 ORDER BY version ASC`
 
-	saveSnapshotQuery = `INSERT INTO microservices.snapshots as s (aggregate_id, aggregate_type, data, version, timestamp)
-	VALUES ($1, $2, $3, $4, now()) ON CONFILICT (aggregate_id) DO UPDATE
-	SET data = $3, version = $4, timestamp = now()`
+	getEventsByVersionRangeQuery = `SELECT event_id, aggregate_id, aggregate_type, event_type, data, version, timestamp, metadata, schema_version, data_compression
+	FROM microservices.events e WHERE aggregate_id = $1 AND version > $2 AND version <= $3 ORDER BY version ASC`
 
-	getSnapshotQuery = `SELECT aggregate_id, aggregate_type, data, version FROM microservices.snapshots s
+	getVersionAsOfQuery = `SELECT COALESCE(MAX(version), 0) FROM microservices.events e WHERE aggregate_id = $1 AND timestamp <= $2`
+
+	saveSnapshotQuery = `INSERT INTO microservices.snapshots as s (aggregate_id, aggregate_type, data, version, schema_version, data_compression, subject_id, timestamp)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, now()) ON CONFLICT (aggregate_id) DO UPDATE
+	SET data = $3, version = $4, schema_version = $5, data_compression = $6, subject_id = $7, timestamp = now() WHERE s.version <= $4`
+
+	getSnapshotQuery = `SELECT aggregate_id, aggregate_type, data, version, schema_version, data_compression, subject_id, timestamp FROM microservices.snapshots s
 	WHERE aggregate_id = $1`
 
+	purgeSnapshotsQuery = `DELETE FROM microservices.snapshots s
+	WHERE ($1::text IS NULL OR s.aggregate_type = $1)
+	AND ($2::integer IS NULL OR s.schema_version = $2)
+	AND ($3::integer IS NULL OR s.schema_version < $3)`
+
 	handleConcurrentWriteQuery = `SELECT aggregate_id FROM microservices.events e WHERE e.aggregate_id = $1 LIMIT 1 FOR UPDATE`
+
+	lockStreamWriterQuery = `SELECT pg_advisory_xact_lock(hashtext('microservices.events'), hashtext($1))`
+
+	getStreamVersionQuery = `SELECT COALESCE(MAX(version), 0), COUNT(*) > 0 FROM microservices.events e WHERE e.aggregate_id = $1`
+
+	saveOutboxQuery = `INSERT INTO microservices.outbox (event_id, aggregate_id, aggregate_type, event_type, data, version, metadata, timestamp, schema_version)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	lockOutboxRelayQuery = `SELECT pg_try_advisory_xact_lock(hashtext('microservices.outbox'))`
+
+	getPendingOutboxQuery = `SELECT id, event_id, aggregate_id, aggregate_type, event_type, data, version, metadata, timestamp, schema_version, attempts, next_attempt_at
+	FROM microservices.outbox o WHERE sent_at IS NULL
+	AND NOT EXISTS (SELECT 1 FROM microservices.outbox b WHERE b.aggregate_id = o.aggregate_id AND b.sent_at IS NULL AND b.id <= o.id AND b.next_attempt_at > now())
+	ORDER BY id ASC LIMIT $1`
+
+	purgeSentOutboxQuery = `DELETE FROM microservices.outbox o WHERE sent_at IS NOT NULL AND sent_at < now() - $1 * interval '1 millisecond'`
+
+	markOutboxSentQuery = `UPDATE microservices.outbox SET sent_at = now(), last_error = NULL WHERE id = ANY($1)`
+
+	markOutboxFailedQuery = `UPDATE microservices.outbox SET attempts = attempts + 1, next_attempt_at = $2, last_error = $3 WHERE id = ANY($1)`
+
+	lockEventWriterQuery = `SELECT pg_advisory_xact_lock_shared(hashtext('microservices.events.position') & 2147483647)`
+
+	getEventWritersQuery = `SELECT COALESCE(array_agg(l.virtualtransaction), '{}') FROM pg_locks l
+	WHERE l.locktype = 'advisory' AND l.classid = 0 AND l.objid = (hashtext('microservices.events.position') & 2147483647)::oid AND l.objsubid = 1
+	AND l.granted AND l.pid <> pg_backend_pid()`
+
+	countEventWritersQuery = `SELECT COUNT(*) FROM pg_locks l
+	WHERE l.locktype = 'advisory' AND l.classid = 0 AND l.objid = (hashtext('microservices.events.position') & 2147483647)::oid AND l.objsubid = 1
+	AND l.virtualtransaction = ANY($1)`
+
+	readAllQuery = `SELECT position, event_id, aggregate_id, aggregate_type, event_type, data, version, timestamp, metadata, schema_version, data_compression
+	FROM (SELECT position, event_id::text, aggregate_id::text, aggregate_type::text, event_type::text, data, version, timestamp, metadata, schema_version, data_compression
+		FROM microservices.events
+		UNION ALL
+		SELECT position, event_id::text, aggregate_id::text, aggregate_type::text, event_type::text, data, 0, timestamp, metadata, 1, ''
+		FROM microservices.stream_tombstones) e
+	WHERE position > $1
+	AND ($3::text[] IS NULL OR aggregate_type = ANY($3)) AND ($4::text[] IS NULL OR event_type = ANY($4))
+	AND ($5::timestamptz IS NULL OR timestamp >= $5) AND ($6::timestamptz IS NULL OR timestamp < $6)
+	AND position <= $7
+	ORDER BY position ASC LIMIT $2`
+
+	getLastPositionQuery = `SELECT GREATEST((SELECT COALESCE(MAX(position), 0) FROM microservices.events),
+	(SELECT COALESCE(MAX(position), 0) FROM microservices.stream_tombstones))`
+
+	getCheckpointQuery = `SELECT position FROM microservices.subscription_checkpoints c WHERE subscription_id = $1`
+
+	saveCheckpointQuery = `INSERT INTO microservices.subscription_checkpoints as c (subscription_id, position, updated_at)
+	VALUES ($1, $2, now()) ON CONFLICT (subscription_id) DO UPDATE
+	SET position = $2, updated_at = now()`
+
+	createKeyQuery = `INSERT INTO microservices.encryption_keys (subject_id, encrypted_key, created_at)
+	VALUES ($1, $2, now()) ON CONFLICT (subject_id) DO NOTHING`
+
+	getKeyQuery = `SELECT encrypted_key FROM microservices.encryption_keys k WHERE subject_id = $1`
+
+	deleteKeyQuery = `INSERT INTO microservices.encryption_keys as k (subject_id, encrypted_key, created_at, forgotten_at)
+	VALUES ($1, NULL, now(), now()) ON CONFLICT (subject_id) DO UPDATE SET encrypted_key = NULL, forgotten_at = now()`
+
+	getStreamStateQuery = `SELECT state FROM microservices.streams s WHERE aggregate_id = $1`
+
+	getStreamStateTxQuery = `SELECT state, aggregate_type FROM microservices.streams s WHERE aggregate_id = $1 FOR UPDATE`
+
+	getStreamAggregateTypeQuery = `SELECT aggregate_type FROM microservices.events e WHERE aggregate_id = $1 LIMIT 1`
+
+	saveStreamStateQuery = `INSERT INTO microservices.streams as s (aggregate_id, aggregate_type, state, updated_at)
+	VALUES ($1, $2, $3, now()) ON CONFLICT (aggregate_id) DO UPDATE SET state = $3, updated_at = now()`
+
+	deleteStreamEventsQuery = `DELETE FROM microservices.events e WHERE aggregate_id = $1`
+
+	deleteSnapshotQuery = `DELETE FROM microservices.snapshots s WHERE aggregate_id = $1`
+
+	deleteStreamOutboxQuery = `DELETE FROM microservices.outbox o WHERE aggregate_id = $1`
+
+	saveTombstoneQuery = `INSERT INTO microservices.stream_tombstones (event_id, aggregate_id, aggregate_type, event_type, data, metadata, timestamp)
+	VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING position`
+
+	getArchiveCutoffVersionQuery = `SELECT COALESCE(MAX(version), 0) FROM microservices.events e WHERE aggregate_id = $1 AND timestamp < $2`
+
+	saveArchiveQuery = `INSERT INTO microservices.archives (aggregate_id, aggregate_type, segment_key, from_version, to_version, from_timestamp, to_timestamp, events_count, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, now())`
+
+	deleteArchivedEventsQuery = `DELETE FROM microservices.events e WHERE aggregate_id = $1 AND version >= $2 AND version <= $3`
+
+	getArchivePointersQuery = `SELECT aggregate_id, aggregate_type, segment_key, from_version, to_version, from_timestamp, to_timestamp, events_count
+	FROM microservices.archives a WHERE aggregate_id = $1 AND to_version > $2 AND from_version <= $3 ORDER BY from_version ASC`
+
+	deleteArchivesQuery = `DELETE FROM microservices.archives a WHERE aggregate_id = $1 RETURNING segment_key`
+
+	findArchiveCandidatesQuery = `SELECT e.aggregate_id, MIN(e.aggregate_type), COALESCE(MIN(s.state), 'active')
+	FROM microservices.events e LEFT JOIN microservices.streams s ON s.aggregate_id = e.aggregate_id
+	WHERE ($1::text[] IS NULL OR e.aggregate_type = ANY($1)) AND (s.state IS NULL OR s.state IN ('active', 'closed'))
+	GROUP BY e.aggregate_id
+	HAVING COUNT(*) > 1 AND (MIN(e.timestamp) < $2 OR ($3 AND MIN(s.state) = 'closed'))
+	ORDER BY MIN(e.timestamp) ASC LIMIT $4`
+
+	getSagaQuery = `SELECT saga_id, saga_type, correlation_key, status, state, steps, COALESCE(failure_reason, ''), version, created_at, updated_at
+	FROM microservices.sagas s WHERE saga_type = $1 AND correlation_key = $2`
+
+	isSagaEventProcessedQuery = `SELECT EXISTS (SELECT 1 FROM microservices.saga_events se WHERE saga_id = $1 AND event_id = $2)`
+
+	createSagaQuery = `INSERT INTO microservices.sagas (saga_id, saga_type, correlation_key, status, state, steps, failure_reason, version, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, now(), now()) ON CONFLICT (saga_type, correlation_key) DO NOTHING`
+
+	updateSagaQuery = `UPDATE microservices.sagas s SET status = $2, state = $3, steps = $4, failure_reason = NULLIF($5, ''), version = $6, updated_at = now()
+	WHERE saga_id = $1 AND version = $7`
+
+	saveSagaEventQuery = `INSERT INTO microservices.saga_events (saga_id, event_id, processed_at) VALUES ($1, $2, now())`
+
+	scheduleEntryQuery = `INSERT INTO microservices.scheduled_entries as s (key, entry_type, payload, due_at, attempts, created_at)
+	VALUES ($1, $2, $3, $4, 0, now()) ON CONFLICT (key) DO UPDATE
+	SET entry_type = $2, payload = $3, due_at = $4, attempts = 0, lock_token = NULL, locked_until = NULL, last_error = NULL, failed_at = NULL, created_at = now()`
+
+	cancelEntryQuery = `DELETE FROM microservices.scheduled_entries s WHERE key = $1`
+
+	claimDueEntriesQuery = `UPDATE microservices.scheduled_entries s
+	SET lock_token = $1, locked_until = now() + $2 * interval '1 millisecond', attempts = attempts + 1
+	WHERE id IN (SELECT id FROM microservices.scheduled_entries WHERE due_at <= now() AND failed_at IS NULL
+	AND (locked_until IS NULL OR locked_until < now()) ORDER BY due_at ASC LIMIT $3 FOR UPDATE SKIP LOCKED)
+	RETURNING id, key, entry_type, payload, due_at, attempts, created_at`
+
+	completeEntryQuery = `DELETE FROM microservices.scheduled_entries s WHERE id = $1 AND lock_token = $2`
+
+	retryEntryQuery = `UPDATE microservices.scheduled_entries s SET due_at = $3, lock_token = NULL, locked_until = NULL, last_error = $4
+	WHERE id = $1 AND lock_token = $2`
+
+	failEntryQuery = `UPDATE microservices.scheduled_entries s SET failed_at = now(), lock_token = NULL, locked_until = NULL, last_error = $3
+	WHERE id = $1 AND lock_token = $2`
+
+	releaseEntriesQuery = `UPDATE microservices.scheduled_entries s SET lock_token = NULL, locked_until = NULL, attempts = attempts - 1
+	WHERE id = ANY($1) AND lock_token = $2`
+
+	saveIdempotencyKeyQuery = `INSERT INTO microservices.idempotency_keys as k (idempotency_key, aggregate_id, aggregate_type, version, created_at, expires_at)
+	VALUES ($1, $2, $3, $4, now(), now() + $5 * interval '1 millisecond') ON CONFLICT (idempotency_key, aggregate_id) DO UPDATE
+	SET aggregate_type = $3, version = $4, created_at = now(), expires_at = now() + $5 * interval '1 millisecond' WHERE k.expires_at <= now()`
+
+	getIdempotencyKeyQuery = `SELECT idempotency_key, aggregate_id, aggregate_type, version, created_at, expires_at
+	FROM microservices.idempotency_keys k WHERE idempotency_key = $1 AND aggregate_id = $2`
+
+	getIdempotencyRecordsQuery = `SELECT idempotency_key, aggregate_id, aggregate_type, version, created_at, expires_at
+	FROM microservices.idempotency_keys k WHERE idempotency_key = $1 AND expires_at > now() ORDER BY created_at ASC`
+
+	purgeIdempotencyKeysQuery = `DELETE FROM microservices.idempotency_keys k WHERE expires_at <= now()`
 )
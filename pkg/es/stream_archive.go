@@ -0,0 +1,517 @@
+package es
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/klauspost/compress/gzip"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/es/serializer"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+// ArchivePointer reference to archived segment with stream events fromVersion..toVersion left in microservices.archives.
+type ArchivePointer struct {
+	AggregateID   string
+	AggregateType AggregateType
+	SegmentKey    string
+	FromVersion   uint64
+	ToVersion     uint64
+	FromTimestamp time.Time
+	ToTimestamp   time.Time
+	EventsCount   int
+}
+
+// ArchiveCandidate stream having events which can be archived.
+type ArchiveCandidate struct {
+	AggregateID   string
+	AggregateType AggregateType
+	State         StreamState
+}
+
+// archivedEvent NDJSON line of archive segment, events are archived as stored, still compressed and encrypted.
+type archivedEvent struct {
+	Event
+	DataCompression CompressionAlgorithm `json:"dataCompression,omitempty"`
+}
+
+type pgQuerier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// FindArchiveCandidates find streams of given aggregate types with events older than cutoff,
+// closed streams are returned regardless of cutoff if includeClosed is set.
+func (p *pgEventStore) FindArchiveCandidates(ctx context.Context, aggregateTypes []AggregateType, cutoff time.Time, includeClosed bool, limit int) ([]ArchiveCandidate, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.FindArchiveCandidates")
+	defer span.Finish()
+	span.LogFields(log.String("cutoff", cutoff.String()), log.Bool("includeClosed", includeClosed), log.Int("limit", limit))
+
+	if limit <= 0 {
+		return nil, tracing.TraceWithErr(span, errors.Wrapf(ErrInvalidLimit, "limit: %d", limit))
+	}
+
+	rows, err := p.db.Query(ctx, findArchiveCandidatesQuery, ReadAllFilter{AggregateTypes: aggregateTypes}.aggregateTypes(), cutoff, includeClosed, limit)
+	if err != nil {
+		p.log.Errorf("(FindArchiveCandidates) db.Query err: %v", err)
+		return nil, tracing.TraceWithErr(span, errors.Wrap(err, "db.Query"))
+	}
+	defer rows.Close()
+
+	candidates := make([]ArchiveCandidate, 0, limit)
+	for rows.Next() {
+		var candidate ArchiveCandidate
+		if err := rows.Scan(&candidate.AggregateID, &candidate.AggregateType, &candidate.State); err != nil {
+			p.log.Errorf("(FindArchiveCandidates) rows.Scan err: %v", err)
+			return nil, tracing.TraceWithErr(span, errors.Wrap(err, "rows.Scan"))
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	if err := rows.Err(); err != nil {
+		p.log.Errorf("(FindArchiveCandidates) rows.Err err: %v", err)
+		return nil, tracing.TraceWithErr(span, errors.Wrap(err, "rows.Err"))
+	}
+
+	return candidates, nil
+}
+
+// ArchiveStream move stream events older than cutoff into compressed NDJSON segment of ArchiveStore.
+// Aggregate must be new empty instance of the stream type with stream id, it is loaded to leave snapshot covering archived events.
+// The last stream event always stays in the table, so stream version and Exists are not affected.
+// Archived events are removed from the $all stream, ReadAll, Subscription and ProjectionReplayer do not see them anymore,
+// replays of projections covering archived streams need their events from ArchiveStore.
+// Returns nil pointer if there is nothing to archive.
+func (p *pgEventStore) ArchiveStream(ctx context.Context, aggregate Aggregate, cutoff time.Time) (*ArchivePointer, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.ArchiveStream")
+	defer span.Finish()
+	span.LogFields(log.String("aggregateID", aggregate.GetID()), log.String("cutoff", cutoff.String()))
+
+	if p.archive == nil {
+		return nil, tracing.TraceWithErr(span, ErrArchiveStoreNotConfigured)
+	}
+
+	snapshotVersion, err := p.ensureArchiveSnapshot(ctx, aggregate)
+	if err != nil {
+		return nil, tracing.TraceWithErr(span, err)
+	}
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		p.log.Errorf("(ArchiveStream) db.Begin err: %v", err)
+		return nil, tracing.TraceWithErr(span, errors.Wrap(err, "db.Begin"))
+	}
+
+	pointer, err := p.archiveStreamTx(ctx, tx, aggregate.GetID(), cutoff, snapshotVersion)
+	if err != nil {
+		return nil, RollBackTx(ctx, tx, tracing.TraceWithErr(span, err))
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, tracing.TraceWithErr(span, errors.Wrap(err, "tx.Commit"))
+	}
+
+	if pointer != nil {
+		p.log.Infof("(ArchiveStream) aggregateID: %s, segment: %s, versions: %d-%d, events: %d", pointer.AggregateID, pointer.SegmentKey, pointer.FromVersion, pointer.ToVersion, pointer.EventsCount)
+	}
+	return pointer, nil
+}
+
+// ensureArchiveSnapshot make sure stream has snapshot, so Load does not need archived events, returns snapshot version.
+func (p *pgEventStore) ensureArchiveSnapshot(ctx context.Context, aggregate Aggregate) (uint64, error) {
+	snapshot, err := p.GetSnapshot(ctx, aggregate.GetID())
+	if err != nil && !isSnapshotMissing(err) {
+		return 0, errors.Wrap(err, "GetSnapshot")
+	}
+
+	if err := p.Load(ctx, aggregate); err != nil {
+		return 0, errors.Wrap(err, "Load")
+	}
+
+	if snapshot != nil && snapshot.Version == aggregate.GetVersion() && snapshot.SchemaVersion == SnapshotSchemaVersion(aggregate) {
+		return snapshot.Version, nil
+	}
+
+	aggregate.ToSnapshot()
+	if err := p.SaveSnapshot(ctx, aggregate); err != nil {
+		return 0, errors.Wrap(err, "SaveSnapshot")
+	}
+	return aggregate.GetVersion(), nil
+}
+
+func (p *pgEventStore) archiveStreamTx(ctx context.Context, tx pgx.Tx, aggregateID string, cutoff time.Time, maxVersion uint64) (*ArchivePointer, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.archiveStreamTx")
+	defer span.Finish()
+
+	if _, err := tx.Exec(ctx, handleConcurrentWriteQuery, aggregateID); err != nil {
+		return nil, errors.Wrap(err, "tx.Exec")
+	}
+
+	streamVersion, exists, err := p.getStreamVersionTx(ctx, tx, aggregateID)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var toVersion uint64
+	if err := tx.QueryRow(ctx, getArchiveCutoffVersionQuery, aggregateID, cutoff).Scan(&toVersion); err != nil {
+		return nil, errors.Wrap(err, "tx.QueryRow")
+	}
+
+	// keep the last event and events not covered by snapshot
+	if toVersion >= streamVersion {
+		toVersion = streamVersion - 1
+	}
+	if toVersion > maxVersion {
+		toVersion = maxVersion
+	}
+	if toVersion == 0 {
+		return nil, nil
+	}
+
+	events, err := p.loadStoredEventsTx(ctx, tx, aggregateID, toVersion)
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+
+	first, last := events[0], events[len(events)-1]
+	pointer := &ArchivePointer{
+		AggregateID:   aggregateID,
+		AggregateType: first.GetAggregateType(),
+		SegmentKey:    fmt.Sprintf("%s/%s/%020d-%020d.ndjson.gz", first.GetAggregateType(), aggregateID, first.GetVersion(), last.GetVersion()),
+		FromVersion:   first.GetVersion(),
+		ToVersion:     last.GetVersion(),
+		FromTimestamp: first.GetTimeStamp(),
+		ToTimestamp:   last.GetTimeStamp(),
+		EventsCount:   len(events),
+	}
+
+	segment, err := encodeArchiveSegment(events)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.archive.WriteSegment(ctx, pointer.SegmentKey, segment); err != nil {
+		p.log.Errorf("(archiveStreamTx) archive.WriteSegment err: %v", err)
+		return nil, errors.Wrap(err, "archive.WriteSegment")
+	}
+
+	if _, err := tx.Exec(ctx, saveArchiveQuery, pointer.AggregateID, pointer.AggregateType, pointer.SegmentKey, pointer.FromVersion, pointer.ToVersion,
+		pointer.FromTimestamp, pointer.ToTimestamp, pointer.EventsCount); err != nil {
+		p.log.Errorf("(archiveStreamTx) tx.Exec err: %v", err)
+		return nil, errors.Wrap(err, "tx.Exec")
+	}
+
+	result, err := tx.Exec(ctx, deleteArchivedEventsQuery, aggregateID, pointer.FromVersion, pointer.ToVersion)
+	if err != nil {
+		p.log.Errorf("(archiveStreamTx) tx.Exec err: %v", err)
+		return nil, errors.Wrap(err, "tx.Exec")
+	}
+	if result.RowsAffected() != int64(len(events)) {
+		return nil, errors.Errorf("archived %d events, deleted %d", len(events), result.RowsAffected())
+	}
+
+	span.LogFields(log.String("segment", pointer.SegmentKey), log.Int("events", len(events)))
+	return pointer, nil
+}
+
+// loadStoredEventsTx load stream events up to toVersion as stored, without decryption, decompression or upcasting.
+func (p *pgEventStore) loadStoredEventsTx(ctx context.Context, tx pgx.Tx, aggregateID string, toVersion uint64) ([]archivedEvent, error) {
+	rows, err := tx.Query(ctx, getEventsByVersionRangeQuery, aggregateID, 0, toVersion)
+	if err != nil {
+		p.log.Errorf("(loadStoredEventsTx) tx.Query err: %v", err)
+		return nil, errors.Wrap(err, "tx.Query")
+	}
+	defer rows.Close()
+
+	events := make([]archivedEvent, 0, eventsCapacity)
+	for rows.Next() {
+		var event archivedEvent
+		if err := rows.Scan(
+			&event.EventID,
+			&event.AggregateID,
+			&event.AggregateType,
+			&event.EventType,
+			&event.Data,
+			&event.Version,
+			&event.Timestamp,
+			&event.Metadata,
+			&event.SchemaVersion,
+			&event.DataCompression,
+		); err != nil {
+			p.log.Errorf("(loadStoredEventsTx) rows.Scan err: %v", err)
+			return nil, errors.Wrap(err, "rows.Scan")
+		}
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		p.log.Errorf("(loadStoredEventsTx) rows.Err err: %v", err)
+		return nil, errors.Wrap(err, "rows.Err")
+	}
+
+	return events, nil
+}
+
+// loadFullHistory raise archived and stored events after current aggregate version up to toVersion,
+// archive pointers and events are read from one database snapshot, so concurrent archiving is never observed half done.
+func (p *pgEventStore) loadFullHistory(ctx context.Context, aggregate Aggregate, toVersion uint64) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.loadFullHistory")
+	defer span.Finish()
+
+	if p.archive == nil {
+		fromVersion := aggregate.GetVersion()
+		err := p.loadAggregateEventsByVersion(ctx, p.db, aggregate, toVersion)
+		if errors.Is(err, ErrInvalidEventVersion) {
+			if archivedErr := p.archivedRangeErr(ctx, aggregate.GetID(), fromVersion, toVersion); archivedErr != nil {
+				return tracing.TraceWithErr(span, archivedErr)
+			}
+		}
+		return err
+	}
+
+	tx, err := p.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		p.log.Errorf("(loadFullHistory) db.BeginTx err: %v", err)
+		return tracing.TraceWithErr(span, errors.Wrap(err, "db.BeginTx"))
+	}
+	defer tx.Rollback(ctx) // nolint: errcheck
+
+	if err := p.loadArchivedEvents(ctx, tx, aggregate, toVersion); err != nil {
+		return tracing.TraceWithErr(span, err)
+	}
+
+	if err := p.loadAggregateEventsByVersion(ctx, tx, aggregate, toVersion); err != nil {
+		return tracing.TraceWithErr(span, err)
+	}
+
+	return nil
+}
+
+// loadArchivedEvents raise archived events after current aggregate version up to toVersion
+func (p *pgEventStore) loadArchivedEvents(ctx context.Context, q pgQuerier, aggregate Aggregate, toVersion uint64) error {
+	events, err := p.readArchivedEvents(ctx, q, aggregate.GetID(), aggregate.GetVersion(), toVersion)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		deserializedEvent, err := p.deserializeEvent(event)
+		if err != nil {
+			return errors.Wrap(err, "serializer.DeserializeEvent")
+		}
+
+		if err := aggregate.RaiseEvent(deserializedEvent); err != nil {
+			return errors.Wrap(err, "RaiseEvent")
+		}
+	}
+
+	return nil
+}
+
+// readArchivedEvents read decoded and upcasted archived events after fromVersion up to toVersion
+func (p *pgEventStore) readArchivedEvents(ctx context.Context, q pgQuerier, aggregateID string, fromVersion, toVersion uint64) ([]Event, error) {
+	pointers, err := p.getArchivePointers(ctx, q, aggregateID, fromVersion, toVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]Event, 0, eventsCapacity)
+	for _, pointer := range pointers {
+		archivedEvents, err := p.readArchiveSegment(ctx, pointer)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, archived := range archivedEvents {
+			if archived.GetVersion() <= fromVersion || archived.GetVersion() > toVersion {
+				continue
+			}
+
+			event := archived.Event
+			if err := p.decodeEventData(ctx, &event, archived.DataCompression); err != nil {
+				return nil, errors.Wrap(err, "decodeEventData")
+			}
+
+			upcastedEvent, err := p.upcasters.Upcast(event)
+			if err != nil {
+				return nil, errors.Wrap(err, "upcasters.Upcast")
+			}
+
+			events = append(events, upcastedEvent)
+		}
+	}
+
+	return events, nil
+}
+
+// archivedRangeErr ErrArchiveStoreNotConfigured if stream has archived events after fromVersion up to toVersion, they can not be loaded without ArchiveStore
+func (p *pgEventStore) archivedRangeErr(ctx context.Context, aggregateID string, fromVersion, toVersion uint64) error {
+	pointers, err := p.getArchivePointers(ctx, p.db, aggregateID, fromVersion, toVersion)
+	if err != nil {
+		return err
+	}
+	if len(pointers) > 0 {
+		return errors.Wrapf(ErrArchiveStoreNotConfigured, "aggregateID: %s, archived versions: %d-%d", aggregateID, pointers[0].FromVersion, pointers[len(pointers)-1].ToVersion)
+	}
+	return nil
+}
+
+func (p *pgEventStore) getArchivePointers(ctx context.Context, q pgQuerier, aggregateID string, fromVersion, toVersion uint64) ([]ArchivePointer, error) {
+	rows, err := q.Query(ctx, getArchivePointersQuery, aggregateID, fromVersion, toVersion)
+	if err != nil {
+		p.log.Errorf("(getArchivePointers) db.Query err: %v", err)
+		return nil, errors.Wrap(err, "db.Query")
+	}
+	defer rows.Close()
+
+	pointers := make([]ArchivePointer, 0)
+	for rows.Next() {
+		var pointer ArchivePointer
+		if err := rows.Scan(&pointer.AggregateID, &pointer.AggregateType, &pointer.SegmentKey, &pointer.FromVersion, &pointer.ToVersion,
+			&pointer.FromTimestamp, &pointer.ToTimestamp, &pointer.EventsCount); err != nil {
+			p.log.Errorf("(getArchivePointers) rows.Scan err: %v", err)
+			return nil, errors.Wrap(err, "rows.Scan")
+		}
+		pointers = append(pointers, pointer)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "rows.Err")
+	}
+
+	return pointers, nil
+}
+
+func (p *pgEventStore) readArchiveSegment(ctx context.Context, pointer ArchivePointer) ([]archivedEvent, error) {
+	if p.archive == nil {
+		return nil, errors.Wrapf(ErrArchiveStoreNotConfigured, "aggregateID: %s", pointer.AggregateID)
+	}
+
+	segment, err := p.archive.ReadSegment(ctx, pointer.SegmentKey)
+	if err != nil {
+		p.log.Errorf("(readArchiveSegment) archive.ReadSegment key: %s, err: %v", pointer.SegmentKey, err)
+		return nil, errors.Wrap(err, "archive.ReadSegment")
+	}
+
+	events, err := decodeArchiveSegment(segment)
+	if err != nil {
+		return nil, errors.Wrapf(err, "segment: %s", pointer.SegmentKey)
+	}
+
+	if len(events) != pointer.EventsCount {
+		return nil, errors.Errorf("segment: %s contains %d events, expected %d", pointer.SegmentKey, len(events), pointer.EventsCount)
+	}
+	return events, nil
+}
+
+// archiveVersionAsOf version of the archived stream as of given time, 0 if time is not covered by archive
+func (p *pgEventStore) archiveVersionAsOf(ctx context.Context, aggregateID string, asOf time.Time) (uint64, error) {
+	pointers, err := p.getArchivePointers(ctx, p.db, aggregateID, 0, math.MaxInt64)
+	if err != nil {
+		return 0, err
+	}
+
+	var version uint64
+	for _, pointer := range pointers {
+		if pointer.FromTimestamp.After(asOf) {
+			break
+		}
+		if !pointer.ToTimestamp.After(asOf) {
+			version = pointer.ToVersion
+			continue
+		}
+
+		events, err := p.readArchiveSegment(ctx, pointer)
+		if err != nil {
+			return 0, err
+		}
+		for _, event := range events {
+			if event.GetTimeStamp().After(asOf) {
+				break
+			}
+			version = event.GetVersion()
+		}
+		break
+	}
+
+	return version, nil
+}
+
+// deleteArchivesTx delete stream archive pointers and return keys of segments to delete after commit
+func (p *pgEventStore) deleteArchivesTx(ctx context.Context, tx pgx.Tx, aggregateID string) ([]string, error) {
+	rows, err := tx.Query(ctx, deleteArchivesQuery, aggregateID)
+	if err != nil {
+		return nil, errors.Wrap(err, "tx.Query")
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, errors.Wrap(err, "rows.Scan")
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, errors.Wrap(rows.Err(), "rows.Err")
+}
+
+// deleteArchiveSegments delete segments of hard deleted stream, failures are only logged because pointers are already gone.
+func (p *pgEventStore) deleteArchiveSegments(ctx context.Context, keys []string) {
+	if p.archive == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := p.archive.DeleteSegment(ctx, key); err != nil {
+			p.log.Warnf("(deleteArchiveSegments) archive.DeleteSegment key: %s, err: %v", key, err)
+		}
+	}
+}
+
+func encodeArchiveSegment(events []archivedEvent) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	for _, event := range events {
+		line, err := serializer.Marshal(event)
+		if err != nil {
+			return nil, errors.Wrap(err, "serializer.Marshal")
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return nil, errors.Wrap(err, "gzip.Write")
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "gzip.Close")
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeArchiveSegment(segment []byte) ([]archivedEvent, error) {
+	r, err := gzip.NewReader(bytes.NewReader(segment))
+	if err != nil {
+		return nil, errors.Wrap(err, "gzip.NewReader")
+	}
+	defer r.Close()
+
+	events := make([]archivedEvent, 0, eventsCapacity)
+	decoder := json.NewDecoder(r)
+	for {
+		var event archivedEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return events, nil
+			}
+			return nil, errors.Wrap(err, "decoder.Decode")
+		}
+		events = append(events, event)
+	}
+}
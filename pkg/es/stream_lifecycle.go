@@ -0,0 +1,318 @@
+package es
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+	uuid "github.com/satori/go.uuid"
+)
+
+// StreamState lifecycle state of the aggregate stream.
+type StreamState string
+
+const (
+	StreamActive      StreamState = "active"
+	StreamClosed      StreamState = "closed"
+	StreamSoftDeleted StreamState = "soft_deleted"
+	StreamHardDeleted StreamState = "hard_deleted"
+)
+
+// Stream lifecycle event types published with EventBus or written to the outbox on stream state change.
+// They are not part of the aggregate stream, so Load never sees them, but they are stored in microservices.stream_tombstones
+// with own position of the $all stream, so ReadAll, Subscription and ProjectionReplayer deliver them to projections.
+// Their Version is 0, the stream version at the time of change is in TombstoneData.
+const (
+	StreamClosedEventType      EventType = "StreamClosed"
+	StreamSoftDeletedEventType EventType = "StreamSoftDeleted"
+	StreamRestoredEventType    EventType = "StreamRestored"
+	StreamHardDeletedEventType EventType = "StreamHardDeleted"
+)
+
+var (
+	// ErrStreamClosed aggregate stream was closed and does not accept new events.
+	ErrStreamClosed = errors.New("Stream closed")
+	// ErrStreamDeleted aggregate stream was soft or hard deleted and does not accept new events.
+	ErrStreamDeleted = errors.New("Stream deleted")
+	// ErrInvalidStreamTransition stream can not change from its current state to the requested one.
+	ErrInvalidStreamTransition = errors.New("Invalid stream state transition")
+)
+
+// StreamStore is responsible for the aggregate stream lifecycle.
+type StreamStore interface {
+	// GetStreamState load state of the aggregate stream, StreamActive if state was never changed.
+	GetStreamState(ctx context.Context, aggregateID string) (StreamState, error)
+
+	// CloseStream reject new events of the active stream, events stay readable.
+	CloseStream(ctx context.Context, aggregateID string) error
+
+	// SoftDeleteStream hide the stream from Exists and reject new events, events are kept and stream may be restored.
+	SoftDeleteStream(ctx context.Context, aggregateID string) error
+
+	// RestoreStream make soft deleted stream active again.
+	RestoreStream(ctx context.Context, aggregateID string) error
+
+	// HardDeleteStream delete stream events, snapshot, outbox records and archived segments, the stream id can not be reused.
+	HardDeleteStream(ctx context.Context, aggregateID string) error
+}
+
+// TombstoneData data of the stream lifecycle events.
+type TombstoneData struct {
+	PreviousState StreamState `json:"previousState"`
+	State         StreamState `json:"state"`
+	// StreamVersion version of the last stream event when state was changed.
+	StreamVersion uint64 `json:"streamVersion"`
+}
+
+// streamTransitions allowed stream state changes with tombstone event type published for them.
+var streamTransitions = map[StreamState]map[StreamState]EventType{
+	StreamActive: {
+		StreamClosed:      StreamClosedEventType,
+		StreamSoftDeleted: StreamSoftDeletedEventType,
+		StreamHardDeleted: StreamHardDeletedEventType,
+	},
+	StreamClosed: {
+		StreamSoftDeleted: StreamSoftDeletedEventType,
+		StreamHardDeleted: StreamHardDeletedEventType,
+	},
+	StreamSoftDeleted: {
+		StreamActive:      StreamRestoredEventType,
+		StreamHardDeleted: StreamHardDeletedEventType,
+	},
+}
+
+// streamStateErr typed error of append to stream in given state, nil for active stream.
+func streamStateErr(aggregateID string, state StreamState) error {
+	switch state {
+	case StreamClosed:
+		return errors.Wrapf(ErrStreamClosed, "aggregateID: %s", aggregateID)
+	case StreamSoftDeleted, StreamHardDeleted:
+		return errors.Wrapf(ErrStreamDeleted, "aggregateID: %s, state: %s", aggregateID, state)
+	}
+	return nil
+}
+
+// GetStreamState load aggregate stream state from microservices.streams
+func (p *pgEventStore) GetStreamState(ctx context.Context, aggregateID string) (StreamState, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.GetStreamState")
+	defer span.Finish()
+	span.LogFields(log.String("aggregateID", aggregateID))
+
+	var state StreamState
+	if err := p.db.QueryRow(ctx, getStreamStateQuery, aggregateID).Scan(&state); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return StreamActive, nil
+		}
+		p.log.Errorf("(GetStreamState) db.QueryRow err: %v", err)
+		return "", tracing.TraceWithErr(span, errors.Wrap(err, "db.QueryRow"))
+	}
+
+	return state, nil
+}
+
+// CloseStream close aggregate stream and publish StreamClosed tombstone
+func (p *pgEventStore) CloseStream(ctx context.Context, aggregateID string) error {
+	return p.changeStreamState(ctx, aggregateID, StreamClosed)
+}
+
+// SoftDeleteStream soft delete aggregate stream and publish StreamSoftDeleted tombstone
+func (p *pgEventStore) SoftDeleteStream(ctx context.Context, aggregateID string) error {
+	return p.changeStreamState(ctx, aggregateID, StreamSoftDeleted)
+}
+
+// RestoreStream restore soft deleted aggregate stream and publish StreamRestored event
+func (p *pgEventStore) RestoreStream(ctx context.Context, aggregateID string) error {
+	return p.changeStreamState(ctx, aggregateID, StreamActive)
+}
+
+// HardDeleteStream delete aggregate events, snapshot and outbox records and publish StreamHardDeleted tombstone
+func (p *pgEventStore) HardDeleteStream(ctx context.Context, aggregateID string) error {
+	return p.changeStreamState(ctx, aggregateID, StreamHardDeleted)
+}
+
+func (p *pgEventStore) changeStreamState(ctx context.Context, aggregateID string, state StreamState) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "pgEventStore.changeStreamState")
+	defer span.Finish()
+	span.LogFields(log.String("aggregateID", aggregateID), log.String("state", string(state)))
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		p.log.Errorf("(changeStreamState) db.Begin err: %v", err)
+		return tracing.TraceWithErr(span, errors.Wrap(err, "db.Begin"))
+	}
+
+	// lock the stream against concurrent appends the same way as writers do
+	if _, err := tx.Exec(ctx, handleConcurrentWriteQuery, aggregateID); err != nil {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, errors.Wrap(err, "tx.Exec")))
+	}
+
+	previousState, aggregateType, err := p.getStreamStateTx(ctx, tx, aggregateID)
+	if err != nil {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, err))
+	}
+
+	version, exists, err := p.getStreamVersionTx(ctx, tx, aggregateID)
+	if err != nil {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, err))
+	}
+	if !exists && previousState == StreamActive {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, errors.Wrapf(ErrAggregateNotFound, "aggregateID: %s", aggregateID)))
+	}
+
+	tombstoneType, ok := streamTransitions[previousState][state]
+	if !ok {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, errors.Wrapf(ErrInvalidStreamTransition, "aggregateID: %s, from: %s, to: %s", aggregateID, previousState, state)))
+	}
+
+	if aggregateType == "" {
+		if err := tx.QueryRow(ctx, getStreamAggregateTypeQuery, aggregateID).Scan(&aggregateType); err != nil {
+			return RollBackTx(ctx, tx, tracing.TraceWithErr(span, errors.Wrap(err, "tx.QueryRow")))
+		}
+	}
+
+	if _, err := tx.Exec(ctx, saveStreamStateQuery, aggregateID, aggregateType, state); err != nil {
+		p.log.Errorf("(changeStreamState) tx.Exec err: %v", err)
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, errors.Wrap(err, "tx.Exec")))
+	}
+
+	var archivedSegments []string
+	if state == StreamHardDeleted {
+		if err := p.deleteStreamTx(ctx, tx, aggregateID); err != nil {
+			return RollBackTx(ctx, tx, tracing.TraceWithErr(span, err))
+		}
+		if archivedSegments, err = p.deleteArchivesTx(ctx, tx, aggregateID); err != nil {
+			return RollBackTx(ctx, tx, tracing.TraceWithErr(span, err))
+		}
+	}
+
+	tombstone, err := p.newTombstoneEvent(ctx, aggregateID, aggregateType, tombstoneType, TombstoneData{PreviousState: previousState, State: state, StreamVersion: version})
+	if err != nil {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, err))
+	}
+
+	if err := p.saveTombstoneTx(ctx, tx, &tombstone); err != nil {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, err))
+	}
+
+	if err := p.processEventsTx(ctx, tx, []Event{tombstone}); err != nil {
+		return RollBackTx(ctx, tx, tracing.TraceWithErr(span, errors.Wrap(err, "processEventsTx")))
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return tracing.TraceWithErr(span, errors.Wrap(err, "tx.Commit"))
+	}
+
+	p.deleteArchiveSegments(ctx, archivedSegments)
+	p.log.Infof("(changeStreamState) aggregateID: %s, from: %s, to: %s", aggregateID, previousState, state)
+	return nil
+}
+
+// getStreamStateTx load stream state and aggregate type, StreamActive with empty type if state was never changed
+func (p *pgEventStore) getStreamStateTx(ctx context.Context, tx pgx.Tx, aggregateID string) (StreamState, AggregateType, error) {
+	var state StreamState
+	var aggregateType AggregateType
+	if err := tx.QueryRow(ctx, getStreamStateTxQuery, aggregateID).Scan(&state, &aggregateType); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return StreamActive, "", nil
+		}
+		p.log.Errorf("(getStreamStateTx) tx.QueryRow err: %v", err)
+		return "", "", errors.Wrap(err, "tx.QueryRow")
+	}
+
+	return state, aggregateType, nil
+}
+
+// checkStreamStateTx reject append to closed or deleted stream
+func (p *pgEventStore) checkStreamStateTx(ctx context.Context, tx pgx.Tx, aggregateID string) error {
+	state, _, err := p.getStreamStateTx(ctx, tx, aggregateID)
+	if err != nil {
+		return err
+	}
+	return streamStateErr(aggregateID, state)
+}
+
+// deleteStreamTx delete all stream events, its snapshot and outbox records, pending ones are not published anymore
+func (p *pgEventStore) deleteStreamTx(ctx context.Context, tx pgx.Tx, aggregateID string) error {
+	result, err := tx.Exec(ctx, deleteStreamEventsQuery, aggregateID)
+	if err != nil {
+		p.log.Errorf("(deleteStreamTx) tx.Exec err: %v", err)
+		return errors.Wrap(err, "tx.Exec")
+	}
+
+	if _, err := tx.Exec(ctx, deleteSnapshotQuery, aggregateID); err != nil {
+		p.log.Errorf("(deleteStreamTx) tx.Exec err: %v", err)
+		return errors.Wrap(err, "tx.Exec")
+	}
+
+	outboxResult, err := tx.Exec(ctx, deleteStreamOutboxQuery, aggregateID)
+	if err != nil {
+		p.log.Errorf("(deleteStreamTx) tx.Exec err: %v", err)
+		return errors.Wrap(err, "tx.Exec")
+	}
+
+	p.log.Infof("(deleteStreamTx) aggregateID: %s, deleted events: %d, outbox records: %d", aggregateID, result.RowsAffected(), outboxResult.RowsAffected())
+	return nil
+}
+
+// newTombstoneEvent create lifecycle event with version 0, it is not part of the stream, so it must not take a stream version.
+func (p *pgEventStore) newTombstoneEvent(ctx context.Context, aggregateID string, aggregateType AggregateType, eventType EventType, data TombstoneData) (Event, error) {
+	event := Event{
+		EventID:       uuid.NewV4().String(),
+		AggregateID:   aggregateID,
+		AggregateType: aggregateType,
+		EventType:     eventType,
+		Timestamp:     time.Now().UTC(),
+	}
+
+	if err := event.SetJsonData(data); err != nil {
+		return Event{}, errors.Wrap(err, "SetJsonData")
+	}
+
+	if err := event.setStandardMetadata(ctx, p.cfg.ServiceName); err != nil {
+		return Event{}, errors.Wrap(err, "setStandardMetadata")
+	}
+
+	return event, nil
+}
+
+// saveTombstoneTx store lifecycle event with next position of the $all stream, kept after hard delete
+func (p *pgEventStore) saveTombstoneTx(ctx context.Context, tx pgx.Tx, tombstone *Event) error {
+	if err := p.lockEventWriterTx(ctx, tx); err != nil {
+		return err
+	}
+
+	if err := tx.QueryRow(
+		ctx,
+		saveTombstoneQuery,
+		tombstone.GetEventID(),
+		tombstone.GetAggregateID(),
+		tombstone.GetAggregateType(),
+		tombstone.GetEventType(),
+		tombstone.GetData(),
+		tombstone.GetMetadata(),
+		tombstone.GetTimeStamp(),
+	).Scan(&tombstone.Position); err != nil {
+		p.log.Errorf("(saveTombstoneTx) tx.QueryRow err: %v", err)
+		return errors.Wrap(err, "tx.QueryRow")
+	}
+
+	return nil
+}
+
+// IsStreamLifecycleEvent true for events published on stream state change.
+func (e *Event) IsStreamLifecycleEvent() bool {
+	switch e.GetEventType() {
+	case StreamClosedEventType, StreamSoftDeletedEventType, StreamRestoredEventType, StreamHardDeletedEventType:
+		return true
+	}
+	return false
+}
+
+// IsTombstone true for events published on stream deletion, projections should purge the aggregate data.
+func (e *Event) IsTombstone() bool {
+	return e.GetEventType() == StreamSoftDeletedEventType || e.GetEventType() == StreamHardDeletedEventType
+}
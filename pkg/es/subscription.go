@@ -0,0 +1,159 @@
+package es
+
+import (
+	"context"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/logger"
+	"github.com/saeed903/microservice_eventsourcing_package/pkg/tracing"
+)
+
+const (
+	defaultSubscriptionBatchSize    = 100
+	defaultSubscriptionPollInterval = 500 * time.Millisecond
+)
+
+// SubscriptionHandler process batch of events delivered by Subscription.
+type SubscriptionHandler func(ctx context.Context, events []Event) error
+
+// SubscriptionConfig catch-up subscription config
+type SubscriptionConfig struct {
+	Name         string        `mapstructure:"name" validate:"required"`
+	BatchSize    int           `mapstructure:"batchSize" validate:"gte=0"`
+	PollInterval time.Duration `mapstructure:"pollInterval"`
+	// MaxHandlerAttempts failed handler attempts of one batch before Run stops with the handler error, 0 retries forever.
+	MaxHandlerAttempts int           `mapstructure:"maxHandlerAttempts" validate:"gte=0"`
+	Filter             ReadAllFilter `mapstructure:"-"`
+}
+
+// subscriptionHandlerError failure of the SubscriptionHandler, counted against MaxHandlerAttempts.
+type subscriptionHandlerError struct {
+	cause error
+}
+
+func (e *subscriptionHandlerError) Error() string {
+	return "handler: " + e.cause.Error()
+}
+
+func (e *subscriptionHandlerError) Unwrap() error {
+	return e.cause
+}
+
+func (e *subscriptionHandlerError) Cause() error {
+	return e.cause
+}
+
+// Subscription persistent catch-up subscription to the $all stream.
+// It replays history from the last stored checkpoint, then polls for live events,
+// checkpoint is saved only after handler succeeded, so delivery is at-least-once.
+type Subscription struct {
+	log             logger.Logger
+	cfg             SubscriptionConfig
+	eventStore      EventStore
+	checkpointStore CheckpointStore
+	handler         SubscriptionHandler
+}
+
+// NewSubscription Subscription constructor.
+func NewSubscription(log logger.Logger, cfg SubscriptionConfig, eventStore EventStore, checkpointStore CheckpointStore, handler SubscriptionHandler) *Subscription {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultSubscriptionBatchSize
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultSubscriptionPollInterval
+	}
+
+	return &Subscription{
+		log:             log,
+		cfg:             cfg,
+		eventStore:      eventStore,
+		checkpointStore: checkpointStore,
+		handler:         handler,
+	}
+}
+
+// Run start subscription from last checkpoint and process events until context is done,
+// or until handler failed the same batch MaxHandlerAttempts times.
+func (s *Subscription) Run(ctx context.Context) error {
+	position, err := s.checkpointStore.GetCheckpoint(ctx, s.cfg.Name)
+	if err != nil {
+		return errors.Wrap(err, "checkpointStore.GetCheckpoint")
+	}
+
+	s.log.Infof("(Starting Subscription) name: %s, position: %d, batchSize: %d, pollInterval: %s", s.cfg.Name, position, s.cfg.BatchSize, s.cfg.PollInterval)
+
+	live := false
+	failedAttempts := 0
+	for {
+		if ctx.Err() != nil {
+			s.log.Infof("(Subscription) name: %s stopped at position: %d", s.cfg.Name, position)
+			return ctx.Err()
+		}
+
+		count, nextPosition, err := s.processBatch(ctx, position)
+		if err != nil {
+			s.log.Errorf("(Subscription) name: %s, position: %d, err: %v", s.cfg.Name, position, err)
+
+			var handlerErr *subscriptionHandlerError
+			if errors.As(err, &handlerErr) {
+				failedAttempts++
+				if s.cfg.MaxHandlerAttempts > 0 && failedAttempts >= s.cfg.MaxHandlerAttempts {
+					s.log.Errorf("(Subscription) name: %s stopped at position: %d after %d failed handler attempts", s.cfg.Name, position, failedAttempts)
+					return handlerErr.cause
+				}
+			}
+		} else {
+			failedAttempts = 0
+		}
+		position = nextPosition
+
+		// batch was full, continue catching up without waiting
+		if err == nil && count == s.cfg.BatchSize {
+			continue
+		}
+
+		if err == nil && !live {
+			live = true
+			s.log.Infof("(Subscription) name: %s caught up at position: %d, switched to live", s.cfg.Name, position)
+		}
+
+		select {
+		case <-ctx.Done():
+			s.log.Infof("(Subscription) name: %s stopped at position: %d", s.cfg.Name, position)
+			return ctx.Err()
+		case <-time.After(s.cfg.PollInterval):
+		}
+	}
+}
+
+// processBatch read events after position, process with handler and save checkpoint,
+// returns count of read events and position to continue from.
+func (s *Subscription) processBatch(ctx context.Context, position uint64) (int, uint64, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Subscription.processBatch")
+	defer span.Finish()
+	span.LogFields(log.String("subscription", s.cfg.Name), log.Uint64("position", position))
+
+	events, err := s.eventStore.ReadAll(ctx, position, s.cfg.BatchSize, s.cfg.Filter)
+	if err != nil {
+		return 0, position, tracing.TraceWithErr(span, errors.Wrap(err, "eventStore.ReadAll"))
+	}
+
+	if len(events) == 0 {
+		return 0, position, nil
+	}
+
+	if err := s.handler(ctx, events); err != nil {
+		return len(events), position, tracing.TraceWithErr(span, &subscriptionHandlerError{cause: err})
+	}
+
+	lastPosition := events[len(events)-1].GetPosition()
+	if err := s.checkpointStore.SaveCheckpoint(ctx, s.cfg.Name, lastPosition); err != nil {
+		return len(events), position, tracing.TraceWithErr(span, errors.Wrap(err, "checkpointStore.SaveCheckpoint"))
+	}
+
+	span.LogFields(log.Int("events", len(events)), log.Uint64("checkpoint", lastPosition))
+	return len(events), lastPosition, nil
+}
@@ -0,0 +1,114 @@
+package es
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	initialSchemaVersion = 1
+	maxUpcastSteps       = 100
+)
+
+// UpcastFunc transform Event payload from registered schema version to the next one,
+// may change EventType, then chain continue with upcasters of the new EventType.
+type UpcastFunc func(event Event) (Event, error)
+
+type upcasterKey struct {
+	eventType     EventType
+	schemaVersion uint32
+}
+
+// UpcasterRegistry registry of upcasters keyed by EventType and schema version,
+// transforms stored events of old schema versions into the current shape before deserialization.
+type UpcasterRegistry struct {
+	mu             sync.RWMutex
+	upcasters      map[upcasterKey]UpcastFunc
+	currentVersion map[EventType]uint32
+}
+
+// NewUpcasterRegistry UpcasterRegistry constructor.
+func NewUpcasterRegistry() *UpcasterRegistry {
+	return &UpcasterRegistry{
+		upcasters:      make(map[upcasterKey]UpcastFunc),
+		currentVersion: make(map[EventType]uint32),
+	}
+}
+
+// Register add upcaster of EventType from given schema version to fromVersion+1.
+func (r *UpcasterRegistry) Register(eventType EventType, fromVersion uint32, upcast UpcastFunc) *UpcasterRegistry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.upcasters[upcasterKey{eventType: eventType, schemaVersion: fromVersion}] = upcast
+	if fromVersion+1 > r.currentVersion[eventType] {
+		r.currentVersion[eventType] = fromVersion + 1
+	}
+	return r
+}
+
+// CurrentVersion schema version of new events with given EventType.
+func (r *UpcasterRegistry) CurrentVersion(eventType EventType) uint32 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if version, ok := r.currentVersion[eventType]; ok {
+		return version
+	}
+	return initialSchemaVersion
+}
+
+// Upcast apply chained upcasters until the Event reaches current schema version.
+func (r *UpcasterRegistry) Upcast(event Event) (Event, error) {
+	if event.IsForgotten() {
+		return event, nil
+	}
+
+	if event.SchemaVersion == 0 {
+		event.SchemaVersion = initialSchemaVersion
+	}
+
+	for step := 0; step < maxUpcastSteps; step++ {
+		r.mu.RLock()
+		upcast, ok := r.upcasters[upcasterKey{eventType: event.GetEventType(), schemaVersion: event.GetSchemaVersion()}]
+		r.mu.RUnlock()
+		if !ok {
+			return event, nil
+		}
+
+		fromVersion := event.GetSchemaVersion()
+		upcasted, err := upcast(event)
+		if err != nil {
+			return event, errors.Wrapf(err, "upcast eventType: %s, schemaVersion: %d", event.GetEventType(), fromVersion)
+		}
+
+		if upcasted.SchemaVersion <= fromVersion {
+			upcasted.SchemaVersion = fromVersion + 1
+		}
+		event = upcasted
+	}
+
+	return event, errors.Wrapf(ErrInvalidEventVersion, "upcast chain of eventType: %s exceeds %d steps", event.GetEventType(), maxUpcastSteps)
+}
+
+type upcastingProjection struct {
+	registry   *UpcasterRegistry
+	projection Projection
+}
+
+// NewUpcastingProjection wrap Projection to upcast events before When, used for events consumed from message broker.
+func NewUpcastingProjection(registry *UpcasterRegistry, projection Projection) Projection {
+	return &upcastingProjection{registry: registry, projection: projection}
+}
+
+// When upcast event and pass it to the wrapped Projection.
+func (p *upcastingProjection) When(ctx context.Context, event Event) error {
+	upcasted, err := p.registry.Upcast(event)
+	if err != nil {
+		return err
+	}
+
+	return p.projection.When(ctx, upcasted)
+}
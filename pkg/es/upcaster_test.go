@@ -0,0 +1,95 @@
+package es
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestUpcasterRegistryUpcast(t *testing.T) {
+	appendData := func(suffix string) UpcastFunc {
+		return func(event Event) (Event, error) {
+			event.Data = append(event.Data, suffix...)
+			return event, nil
+		}
+	}
+	renameTo := func(eventType EventType) UpcastFunc {
+		return func(event Event) (Event, error) {
+			event.EventType = eventType
+			return event, nil
+		}
+	}
+
+	registry := NewUpcasterRegistry().
+		Register("created", 1, appendData("-v2")).
+		Register("created", 2, appendData("-v3")).
+		Register("renamed_old", 1, renameTo("renamed")).
+		Register("renamed", 2, appendData("-new")).
+		Register("failing", 1, func(event Event) (Event, error) { return event, errors.New("broken") })
+
+	tests := []struct {
+		name        string
+		event       Event
+		wantType    EventType
+		wantVersion uint32
+		wantData    string
+		wantErr     bool
+	}{
+		{name: "chain from first version", event: Event{EventType: "created", SchemaVersion: 1, Data: []byte("d")}, wantType: "created", wantVersion: 3, wantData: "d-v2-v3"},
+		{name: "zero schema version is first version", event: Event{EventType: "created", Data: []byte("d")}, wantType: "created", wantVersion: 3, wantData: "d-v2-v3"},
+		{name: "chain from middle version", event: Event{EventType: "created", SchemaVersion: 2, Data: []byte("d")}, wantType: "created", wantVersion: 3, wantData: "d-v3"},
+		{name: "current version untouched", event: Event{EventType: "created", SchemaVersion: 3, Data: []byte("d")}, wantType: "created", wantVersion: 3, wantData: "d"},
+		{name: "unknown event type untouched", event: Event{EventType: "other", SchemaVersion: 1, Data: []byte("d")}, wantType: "other", wantVersion: 1, wantData: "d"},
+		{name: "renamed type continues with new type chain", event: Event{EventType: "renamed_old", SchemaVersion: 1, Data: []byte("d")}, wantType: "renamed", wantVersion: 3, wantData: "d-new"},
+		{name: "upcaster error", event: Event{EventType: "failing", SchemaVersion: 1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := registry.Upcast(tt.event)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.GetEventType() != tt.wantType || event.GetSchemaVersion() != tt.wantVersion || string(event.GetData()) != tt.wantData {
+				t.Fatalf("Upcast() = %s v%d %q, want %s v%d %q", event.GetEventType(), event.GetSchemaVersion(), event.GetData(), tt.wantType, tt.wantVersion, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestUpcasterRegistryMaxSteps(t *testing.T) {
+	registry := NewUpcasterRegistry()
+	for version := uint32(1); version <= maxUpcastSteps+1; version++ {
+		registry.Register("long", version, func(event Event) (Event, error) { return event, nil })
+	}
+
+	if _, err := registry.Upcast(Event{EventType: "long", SchemaVersion: 1}); !errors.Is(err, ErrInvalidEventVersion) {
+		t.Fatalf("err = %v, want %v", err, ErrInvalidEventVersion)
+	}
+}
+
+func TestUpcasterRegistryCurrentVersion(t *testing.T) {
+	registry := NewUpcasterRegistry().
+		Register("created", 2, func(event Event) (Event, error) { return event, nil }).
+		Register("created", 1, func(event Event) (Event, error) { return event, nil })
+
+	tests := []struct {
+		eventType EventType
+		want      uint32
+	}{
+		{eventType: "created", want: 3},
+		{eventType: "unknown", want: initialSchemaVersion},
+	}
+
+	for _, tt := range tests {
+		if got := registry.CurrentVersion(tt.eventType); got != tt.want {
+			t.Errorf("CurrentVersion(%s) = %d, want %d", tt.eventType, got, tt.want)
+		}
+	}
+}
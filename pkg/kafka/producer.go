@@ -29,6 +29,15 @@ func NewProducer(log logger.Logger, brokers []string) *producer {
 	}
 }
 
+// NewHashProducer create new kafka producer partitioning messages by key
+func NewHashProducer(log logger.Logger, brokers []string) *producer {
+	return &producer{
+		log:     log,
+		brokers: brokers,
+		w:       NewHashWriter(brokers, kafka.LoggerFunc(log.Errorf)),
+	}
+}
+
 // NewAsyncProducer create new kafka producer
 func NewAsyncProducer(log logger.Logger, brokers []string) *producer {
 	return &producer{
@@ -68,6 +77,11 @@ func (p *producer) PublicMessage(ctx context.Context, msgs ...kafka.Message) err
 	return nil
 }
 
+// Balancer partition balancer of the producer writer
+func (p *producer) Balancer() kafka.Balancer {
+	return p.w.Balancer
+}
+
 func (p *producer) Close() error {
 	return p.w.Close()
 }
@@ -24,6 +24,23 @@ func NewWriter(brokers []string, errLogger kafka.Logger) *kafka.Writer {
 	}
 }
 
+// NewHashWriter create new configured kafka writer, messages with the same key are written to the same partition
+func NewHashWriter(brokers []string, errLogger kafka.Logger) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		MaxAttempts:  writerMaxAttempts,
+		ErrorLogger:  errLogger,
+		Compression:  compress.Snappy,
+		ReadTimeout:  writeReadTimeout,
+		WriteTimeout: writerWriteTimeout,
+		BatchTimeout: batchTimeout,
+		BatchSize:    batchSize,
+		Async:        false,
+	}
+}
+
 // NewAsyncWriter Create new configured kafka async writer
 func NewAsyncWriter(brokers []string, errLogger kafka.Logger, log logger.Logger) *kafka.Writer {
 	return &kafka.Writer{